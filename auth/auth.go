@@ -9,3 +9,23 @@ type Authorization interface {
 	// HTTP request.
 	Authorization(*http.Request)
 }
+
+// Challenger is implemented by Authorization types that respond to the
+// challenges of a 407 Proxy Authentication Required response.
+type Challenger interface {
+	Authorization
+	// Challenge accepts one of the challenges sent by the proxy and reports
+	// whether the request should be retried with new credentials.
+	Challenge([]Challenge) bool
+}
+
+// Bearer represents a token for the Bearer authentication scheme.
+type Bearer struct {
+	Token string
+}
+
+// Authorization sets the Proxy-Authorization header in the given HTTP request
+// using the Bearer authentication scheme.
+func (a Bearer) Authorization(req *http.Request) {
+	req.Header.Set("Proxy-Authorization", "Bearer "+a.Token)
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"maps"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseChallenges(t *testing.T) {
+	for _, testcase := range []struct {
+		header string
+		expect []Challenge
+	}{
+		{`Basic realm="proxy"`, []Challenge{{"Basic", map[string]string{"realm": "proxy"}}}},
+		{
+			`Digest Realm="a, b", nonce="x\"y", qop="auth,auth-int", algorithm=SHA-256, Basic realm=p`,
+			[]Challenge{
+				{"Digest", map[string]string{"realm": "a, b", "nonce": `x"y`, "qop": "auth,auth-int", "algorithm": "SHA-256"}},
+				{"Basic", map[string]string{"realm": "p"}},
+			},
+		},
+		{
+			`Negotiate YII=, Bearer, Basic realm="x"`,
+			[]Challenge{
+				{"Negotiate", map[string]string{"": "YII="}},
+				{"Bearer", map[string]string{}},
+				{"Basic", map[string]string{"realm": "x"}},
+			},
+		},
+		{` ,, Bearer   realm = "r" ,error="invalid_token"`, []Challenge{{"Bearer", map[string]string{"realm": "r", "error": "invalid_token"}}}},
+		{`Basic realm="unterminated`, []Challenge{{"Basic", map[string]string{"realm": "unterminated"}}}},
+		{"", nil},
+	} {
+		cs := parseChallenges(testcase.header)
+		if len(cs) != len(testcase.expect) {
+			t.Errorf("%s: expect %v; got %v", testcase.header, testcase.expect, cs)
+			continue
+		}
+		for i, c := range cs {
+			if c.Scheme != testcase.expect[i].Scheme || !maps.Equal(c.Params, testcase.expect[i].Params) {
+				t.Errorf("%s: expect %v; got %v", testcase.header, testcase.expect[i], c)
+			}
+		}
+	}
+
+	resp := &http.Response{Header: make(http.Header)}
+	resp.Header.Add("Proxy-Authenticate", `Digest realm="r", nonce="n"`)
+	resp.Header.Add("Proxy-Authenticate", `Basic realm="r"`)
+	if cs := ParseChallenges(resp); len(cs) != 2 || cs[0].Scheme != "Digest" || cs[1].Scheme != "Basic" {
+		t.Errorf("expect challenges of every header; got %v", cs)
+	}
+
+	c := NewDigestChallenge(`a "realm"`, "nonce", "SHA-256", true)
+	if cs := parseChallenges(c.String()); len(cs) != 1 || !maps.Equal(cs[0].Params, c.Params) {
+		t.Errorf("expect %v parsed back; got %v", c, cs)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Host: "example.com:443"}, Host: "example.com:443", Header: make(http.Header)}
+	d := &Digest{Username: "user", Password: "password"}
+	d.Authorization(req)
+	if v := req.Header.Get("Proxy-Authorization"); v != "" {
+		t.Errorf("expect no credentials before a challenge; got %s", v)
+	}
+
+	if d.Challenge([]Challenge{{"Basic", map[string]string{"realm": "r"}}}) {
+		t.Error("expect Basic challenge declined")
+	}
+	if !d.Challenge([]Challenge{
+		NewDigestChallenge("r", "n1", "MD5", false),
+		NewDigestChallenge("r", "n1", "SHA-256", false),
+		NewDigestChallenge("r", "n1", "SHA-1", false),
+	}) {
+		t.Fatal("expect Digest challenge accepted")
+	}
+	for i := range 2 {
+		d.Authorization(req)
+		c, ok := ParseDigest(req)
+		if !ok {
+			t.Fatalf("#%d expect credentials parsed from %s", i, req.Header.Get("Proxy-Authorization"))
+		}
+		if c.Username() != "user" || c.Nonce() != "n1" || c.NC() != uint64(i+1) || c["algorithm"] != "SHA-256" {
+			t.Errorf("#%d unexpected credentials %v", i, c)
+		}
+		if !c.Verify(req.Method, "password") {
+			t.Errorf("#%d expect credentials verified", i)
+		}
+		if c.Verify(req.Method, "wrong") || c.Verify(http.MethodGet, "password") {
+			t.Errorf("#%d expect credentials of another password or method refused", i)
+		}
+	}
+
+	other := req.Clone(req.Context())
+	other.Host = "example.org:443"
+	if _, ok := ParseDigest(other); ok {
+		t.Error("expect credentials for another uri refused")
+	}
+	req.Header.Set("Proxy-Authorization", strings.Replace(req.Header.Get("Proxy-Authorization"), "username=", "user=", 1))
+	if _, ok := ParseDigest(req); ok {
+		t.Error("expect credentials without username refused")
+	}
+
+	if d.Challenge([]Challenge{NewDigestChallenge("r", "n1", "SHA-256", false)}) {
+		t.Error("expect fresh challenge of the answered nonce declined")
+	}
+	if !d.Challenge([]Challenge{NewDigestChallenge("r", "n2", "SHA-256", true)}) {
+		t.Error("expect stale challenge accepted")
+	}
+	d.Authorization(req)
+	if c, ok := ParseDigest(req); !ok || c.Nonce() != "n2" || c.NC() != 1 {
+		t.Errorf("expect nonce count restarted for the new nonce; got %v", c)
+	}
+}
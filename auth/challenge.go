@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Challenge represents an authentication challenge sent in the
+// Proxy-Authenticate header.
+type Challenge struct {
+	Scheme string
+	// Params holds the auth-params keyed by lowercase name. A token68 value
+	// is stored with an empty key.
+	Params map[string]string
+}
+
+// String formats the challenge as a Proxy-Authenticate header value.
+func (c Challenge) String() string {
+	var b strings.Builder
+	b.WriteString(c.Scheme)
+	if v, ok := c.Params[""]; ok {
+		b.WriteString(" " + v)
+		return b.String()
+	}
+	keys := make([]string, 0, len(c.Params))
+	for k := range c.Params {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for i, k := range keys {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteString(", ")
+		}
+		switch k {
+		case "algorithm", "stale":
+			b.WriteString(k + "=" + c.Params[k])
+		default:
+			b.WriteString(k + "=" + strconv.Quote(c.Params[k]))
+		}
+	}
+	return b.String()
+}
+
+// ParseChallenges parses all challenges from the Proxy-Authenticate headers
+// of the given HTTP response.
+func ParseChallenges(resp *http.Response) (cs []Challenge) {
+	for _, v := range resp.Header.Values("Proxy-Authenticate") {
+		cs = append(cs, parseChallenges(v)...)
+	}
+	return
+}
+
+func parseChallenges(s string) (cs []Challenge) {
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return
+		}
+		tok, rest := token(s)
+		if tok == "" {
+			s = s[1:]
+			continue
+		}
+		rest = strings.TrimLeft(rest, " \t")
+		if len(cs) > 0 && strings.HasPrefix(rest, "=") {
+			var v string
+			v, s = value(strings.TrimLeft(rest[1:], " \t"))
+			cs[len(cs)-1].Params[strings.ToLower(tok)] = v
+			continue
+		}
+		c := Challenge{Scheme: tok, Params: make(map[string]string)}
+		if v, r := token68(rest); v != "" {
+			if r = strings.TrimLeft(r, " \t"); r == "" || r[0] == ',' {
+				c.Params[""] = v
+				rest = r
+			}
+		}
+		cs = append(cs, c)
+		s = rest
+	}
+}
+
+func isTokenChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1
+}
+
+func token(s string) (string, string) {
+	i := 0
+	for i < len(s) && isTokenChar(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func token68(s string) (string, string) {
+	i := 0
+	for i < len(s) && (s[i] >= 'a' && s[i] <= 'z' || s[i] >= 'A' && s[i] <= 'Z' ||
+		s[i] >= '0' && s[i] <= '9' || strings.IndexByte("-._~+/", s[i]) != -1) {
+		i++
+	}
+	if i == 0 {
+		return "", s
+	}
+	for i < len(s) && s[i] == '=' {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func value(s string) (string, string) {
+	if !strings.HasPrefix(s, `"`) {
+		return token(s)
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i++; i < len(s) {
+				b.WriteByte(s[i])
+			}
+		case '"':
+			return b.String(), s[i+1:]
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), ""
+}
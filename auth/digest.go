@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DigestAlgorithms lists the supported Digest algorithms in order of
+// preference.
+var DigestAlgorithms = []string{"SHA-512-256", "SHA-256", "MD5"}
+
+func digestHash(algorithm string) (func() hash.Hash, bool) {
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "", "MD5":
+		return md5.New, true
+	case "SHA-256":
+		return sha256.New, true
+	case "SHA-512-256":
+		return sha512.New512_256, true
+	}
+	return nil, false
+}
+
+func h(fn func() hash.Hash, s ...string) string {
+	hh := fn()
+	hh.Write([]byte(strings.Join(s, ":")))
+	return hex.EncodeToString(hh.Sum(nil))
+}
+
+// digestResponse computes the request-digest defined in RFC 7616.
+func digestResponse(p map[string]string, method, password string) (string, bool) {
+	fn, ok := digestHash(p["algorithm"])
+	if !ok {
+		return "", false
+	}
+	ha1 := h(fn, p["username"], p["realm"], password)
+	if strings.HasSuffix(strings.ToUpper(p["algorithm"]), "-SESS") {
+		ha1 = h(fn, ha1, p["nonce"], p["cnonce"])
+	}
+	ha2 := h(fn, method, p["uri"])
+	if p["qop"] == "" {
+		return h(fn, ha1, p["nonce"], ha2), true
+	}
+	return h(fn, ha1, p["nonce"], p["nc"], p["cnonce"], p["qop"], ha2), true
+}
+
+// requestURI returns the digest-uri of the given HTTP request.
+func requestURI(req *http.Request) string {
+	if req.Method == http.MethodConnect && req.Header.Get(":protocol") == "" {
+		return req.Host
+	}
+	return req.URL.RequestURI()
+}
+
+// Digest represents credentials for HTTP Digest Authentication (RFC 7616).
+// It answers the Digest challenge sent by the proxy, so it must be used
+// through a pointer shared by successive requests.
+type Digest struct {
+	Username string
+	Password string
+
+	mu        sync.Mutex
+	challenge *Challenge
+	nc        uint32
+}
+
+var _ Challenger = &Digest{}
+
+// Authorization sets the Proxy-Authorization header in the given HTTP request
+// using the Digest authentication scheme. It does nothing until a challenge
+// has been accepted.
+func (a *Digest) Authorization(req *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.challenge == nil {
+		return
+	}
+	a.nc++
+	p := map[string]string{
+		"username":  a.Username,
+		"realm":     a.challenge.Params["realm"],
+		"nonce":     a.challenge.Params["nonce"],
+		"uri":       requestURI(req),
+		"algorithm": a.challenge.Params["algorithm"],
+	}
+	if qop := a.challenge.Params["qop"]; qop != "" {
+		for _, i := range strings.Split(qop, ",") {
+			if strings.TrimSpace(i) == "auth" {
+				p["qop"] = "auth"
+				p["nc"] = fmt.Sprintf("%08x", a.nc)
+				p["cnonce"] = rand.Text()
+				break
+			}
+		}
+	}
+	response, _ := digestResponse(p, req.Method, a.Password)
+	var b strings.Builder
+	fmt.Fprintf(&b, "Digest username=%q, realm=%q, nonce=%q, uri=%q, response=%q",
+		p["username"], p["realm"], p["nonce"], p["uri"], response)
+	if p["algorithm"] != "" {
+		b.WriteString(", algorithm=" + p["algorithm"])
+	}
+	if p["qop"] != "" {
+		fmt.Fprintf(&b, ", qop=%s, nc=%s, cnonce=%q", p["qop"], p["nc"], p["cnonce"])
+	}
+	if opaque, ok := a.challenge.Params["opaque"]; ok {
+		fmt.Fprintf(&b, ", opaque=%q", opaque)
+	}
+	req.Header.Set("Proxy-Authorization", b.String())
+}
+
+// Challenge accepts the preferred Digest challenge. It declines a fresh
+// challenge for the nonce already answered, as the credentials were wrong.
+func (a *Digest) Challenge(cs []Challenge) bool {
+	var best *Challenge
+	rank := len(DigestAlgorithms)
+	for i := range cs {
+		if !strings.EqualFold(cs[i].Scheme, "Digest") {
+			continue
+		}
+		alg := strings.TrimSuffix(strings.ToUpper(cs[i].Params["algorithm"]), "-SESS")
+		if alg == "" {
+			alg = "MD5"
+		}
+		if r := slices.Index(DigestAlgorithms, alg); r != -1 && r < rank {
+			c := cs[i]
+			best, rank = &c, r
+		}
+	}
+	if best == nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.challenge != nil && a.challenge.Params["nonce"] == best.Params["nonce"] &&
+		!strings.EqualFold(best.Params["stale"], "true") {
+		return false
+	}
+	a.challenge = best
+	a.nc = 0
+	return true
+}
+
+// DigestCredentials holds the parameters of a Digest Proxy-Authorization
+// header.
+type DigestCredentials map[string]string
+
+// Username returns the username of the credentials.
+func (c DigestCredentials) Username() string { return c["username"] }
+
+// Nonce returns the server nonce answered by the credentials.
+func (c DigestCredentials) Nonce() string { return c["nonce"] }
+
+// NC returns the nonce count of the credentials, or zero if there is none.
+func (c DigestCredentials) NC() uint64 {
+	n, _ := strconv.ParseUint(c["nc"], 16, 32)
+	return n
+}
+
+// Verify reports whether the credentials answer the challenge with the
+// given password for a request using method.
+func (c DigestCredentials) Verify(method, password string) bool {
+	if c["qop"] != "" && c["qop"] != "auth" {
+		return false
+	}
+	response, ok := digestResponse(c, method, password)
+	return ok && subtle.ConstantTimeCompare([]byte(response), []byte(strings.ToLower(c["response"]))) == 1
+}
+
+// ParseDigest extracts the Digest authentication credentials from the
+// Proxy-Authorization header of the given HTTP request. The digest-uri must
+// match the request.
+func ParseDigest(req *http.Request) (DigestCredentials, bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	const prefix = "Digest "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return nil, false
+	}
+	cs := parseChallenges(auth)
+	if len(cs) != 1 {
+		return nil, false
+	}
+	c := DigestCredentials(cs[0].Params)
+	for _, k := range []string{"username", "realm", "nonce", "uri", "response"} {
+		if _, ok := c[k]; !ok {
+			return nil, false
+		}
+	}
+	if c["uri"] != requestURI(req) {
+		return nil, false
+	}
+	return c, true
+}
+
+// NewDigestChallenge returns a Digest challenge for the given realm, nonce and
+// algorithm with qop "auth".
+func NewDigestChallenge(realm, nonce, algorithm string, stale bool) Challenge {
+	c := Challenge{
+		Scheme: "Digest",
+		Params: map[string]string{
+			"realm":     realm,
+			"nonce":     nonce,
+			"qop":       "auth",
+			"algorithm": algorithm,
+		},
+	}
+	if stale {
+		c.Params["stale"] = strconv.FormatBool(stale)
+	}
+	return c
+}
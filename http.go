@@ -10,8 +10,10 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
 
 	"github.com/sunshineplan/httpproxy/auth"
+	"golang.org/x/net/http2"
 	"golang.org/x/net/proxy"
 )
 
@@ -20,6 +22,8 @@ type Dialer struct {
 	proxyAddress string
 
 	// TLSConfig is the optional TLS configuration for HTTPS connections.
+	// If NextProtos is empty, the Dialer offers h2 and http/1.1 through ALPN
+	// and multiplexes tunnels over one connection when h2 is negotiated.
 	TLSConfig *tls.Config
 
 	// ProxyDial specifies the optional dial function for
@@ -28,6 +32,9 @@ type Dialer struct {
 
 	// Auth contains authentication information for the proxy.
 	Auth auth.Authorization
+
+	mu sync.Mutex
+	h2 *session
 }
 
 // NewDialer returns a Dialer that makes HTTP connections to the given
@@ -85,85 +92,147 @@ func FromURL(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
 	return NewDialer(net.JoinHostPort(u.Hostname(), port), config, auth, forward)
 }
 
+// maxChallenges limits how many authentication challenges are answered
+// for a single request.
+const maxChallenges = 3
+
 // connect establishes a connection to the proxy server
-func (d *Dialer) connect(c net.Conn, host string) error {
-	req := &http.Request{
+func (d *Dialer) connect(ctx context.Context, c net.Conn, host string) (net.Conn, error) {
+	c, _, err := d.roundTrip(ctx, c, &http.Request{
 		Method: http.MethodConnect,
 		URL:    &url.URL{Opaque: host},
 		Host:   host,
 		Header: make(http.Header),
-	}
-	if d.Auth != nil {
-		d.Auth.Authorization(req)
-	}
-	if err := req.Write(c); err != nil {
-		c.Close()
-		return err
-	}
-	resp, err := http.ReadResponse(bufio.NewReader(c), req)
-	if err != nil {
-		c.Close()
-		return err
-	}
-	if resp.StatusCode != http.StatusOK {
+	}, http.StatusOK)
+	return c, err
+}
+
+// roundTrip sends req over c and reads the response, which must have the
+// expected status code. A 407 response is retried as long as the Auth
+// accepts its challenges, on a new connection if the proxy closes c.
+// The returned reader holds any bytes after the response header.
+func (d *Dialer) roundTrip(ctx context.Context, c net.Conn, req *http.Request, code int) (net.Conn, *bufio.Reader, error) {
+	br := bufio.NewReader(c)
+	for i := 0; ; i++ {
+		if d.Auth != nil {
+			d.Auth.Authorization(req)
+		}
+		if err := req.Write(c); err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+		if resp.StatusCode == code {
+			return c, br, nil
+		}
+		if d.challenge(resp, i) {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.Close {
+				c.Close()
+				if c, _, err = d.dialProxy(ctx, false); err != nil {
+					return nil, nil, err
+				}
+				br = bufio.NewReader(c)
+			}
+			continue
+		}
 		c.Close()
 		defer resp.Body.Close()
 		status := resp.Status
 		if b, _ := io.ReadAll(resp.Body); len(b) > 0 {
 			status += " : " + string(b)
 		}
-		return errors.New(status)
+		return nil, nil, StatusError(status)
 	}
-	return nil
 }
 
-// Dial connects to the address on the named network using the proxy.
-func (d *Dialer) Dial(network, address string) (conn net.Conn, err error) {
-	switch network {
-	case "tcp", "tcp6", "tcp4":
-	default:
-		return nil, errors.New("network not implemented")
+// challenge reports whether the request refused with resp should be retried
+// after the n-th attempt.
+func (d *Dialer) challenge(resp *http.Response, n int) bool {
+	if resp.StatusCode != http.StatusProxyAuthRequired || n >= maxChallenges {
+		return false
+	}
+	if c, ok := d.Auth.(auth.Challenger); ok {
+		return c.Challenge(auth.ParseChallenges(resp))
+	}
+	return false
+}
+
+// StatusError reports a response from the proxy that refused the request,
+// as opposed to a failure to reach the proxy.
+type StatusError string
+
+func (e StatusError) Error() string { return string(e) }
+
+// dialProxy establishes the transport connection to the proxy server.
+// If alpn is true and h2 is negotiated, an HTTP/2 session is returned
+// instead of the connection.
+func (d *Dialer) dialProxy(ctx context.Context, alpn bool) (conn net.Conn, s *session, err error) {
+	if alpn {
+		if s = d.session(); s != nil {
+			return
+		}
 	}
 	if d.ProxyDial != nil {
-		conn, err = d.ProxyDial(context.Background(), "tcp", d.proxyAddress)
+		conn, err = d.ProxyDial(ctx, "tcp", d.proxyAddress)
 	} else {
-		conn, err = net.Dial("tcp", d.proxyAddress)
+		var dd net.Dialer
+		conn, err = dd.DialContext(ctx, "tcp", d.proxyAddress)
 	}
 	if err != nil {
 		return
 	}
 	if d.TLSConfig != nil {
-		conn = tls.Client(conn, d.TLSConfig)
-	}
-	if err = d.connect(conn, address); err != nil {
-		conn.Close()
-		return nil, err
+		config := d.tlsConfig()
+		if !alpn {
+			config.NextProtos = []string{"http/1.1"}
+		}
+		tlsConn := tls.Client(conn, config)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		if tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+			s, err = d.newSession(tlsConn)
+			return nil, s, err
+		}
+		conn = tlsConn
 	}
 	return
 }
 
+// Dial connects to the address on the named network using the proxy.
+//
+// For udp networks, the returned connection also implements
+// [net.PacketConn] and carries datagrams to the address using
+// CONNECT-UDP (RFC 9298).
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
 // DialContext connects to the address on the named network using the
 // proxy with the provided context.
-func (d *Dialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
 	switch network {
 	case "tcp", "tcp6", "tcp4":
+	case "udp", "udp6", "udp4":
+		return d.dialUDP(ctx, address)
 	default:
 		return nil, errors.New("network not implemented")
 	}
-	if d.ProxyDial != nil {
-		conn, err = d.ProxyDial(ctx, "tcp", d.proxyAddress)
-	} else {
-		var dd net.Dialer
-		conn, err = dd.DialContext(ctx, "tcp", d.proxyAddress)
-	}
+	conn, s, err := d.dialProxy(ctx, true)
 	if err != nil {
-		return
-	}
-	if err = d.connect(conn, address); err != nil {
-		conn.Close()
 		return nil, err
 	}
-	return
+	if s != nil {
+		return d.connectH2(ctx, s, address)
+	}
+	return d.connect(ctx, conn, address)
 }
 
 func dialContext(ctx context.Context, d proxy.Dialer, network, address string) (conn net.Conn, err error) {
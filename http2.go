@@ -0,0 +1,187 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// session is an HTTP/2 connection to the proxy shared by many tunnels.
+type session struct {
+	*http2.ClientConn
+	local, remote net.Addr
+}
+
+// tlsConfig returns the TLS configuration used to connect to the proxy.
+func (d *Dialer) tlsConfig() *tls.Config {
+	config := d.TLSConfig.Clone()
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
+	return config
+}
+
+// session returns the shared HTTP/2 connection if it can take new streams.
+func (d *Dialer) session() *session {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.h2 != nil && d.h2.CanTakeNewRequest() {
+		return d.h2
+	}
+	return nil
+}
+
+// newSession sets up an HTTP/2 connection over c and shares it for
+// subsequent tunnels. The session it replaces is closed once idle.
+func (d *Dialer) newSession(c *tls.Conn) (*session, error) {
+	cc, err := new(http2.Transport).NewClientConn(c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	s := &session{cc, c.LocalAddr(), c.RemoteAddr()}
+	d.mu.Lock()
+	old := d.h2
+	d.h2 = s
+	d.mu.Unlock()
+	if old != nil {
+		go old.Shutdown(context.Background())
+	}
+	return s, nil
+}
+
+// connectH2 opens a CONNECT stream on the HTTP/2 session.
+func (d *Dialer) connectH2(ctx context.Context, s *session, host string) (net.Conn, error) {
+	return d.stream(ctx, s, &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: host},
+		Host:   host,
+		Header: make(http.Header),
+	})
+}
+
+// stream sends req on the HTTP/2 session and returns the stream as a
+// connection once the proxy accepts it. ctx bounds the wait for the
+// proxy, not the stream which outlives it.
+func (d *Dialer) stream(ctx context.Context, s *session, req *http.Request) (net.Conn, error) {
+	for i := 0; ; i++ {
+		streamCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		stop := context.AfterFunc(ctx, cancel)
+		pr, pw := io.Pipe()
+		req = req.WithContext(streamCtx)
+		req.Body = pr
+		if d.Auth != nil {
+			d.Auth.Authorization(req)
+		}
+		resp, err := s.RoundTrip(req)
+		if !stop() && err == nil {
+			resp.Body.Close()
+			err = ctx.Err()
+		}
+		if err != nil {
+			pw.Close()
+			cancel()
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			return &h2Conn{ReadCloser: resp.Body, w: pw, s: s, cancel: cancel}, nil
+		}
+		pw.Close()
+		if d.challenge(resp, i) {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			cancel()
+			continue
+		}
+		defer cancel()
+		defer resp.Body.Close()
+		status := resp.Status
+		if b, _ := io.ReadAll(resp.Body); len(b) > 0 {
+			status += " : " + string(b)
+		}
+		return nil, StatusError(status)
+	}
+}
+
+// h2Conn is a tunnel carried by a single HTTP/2 stream.
+type h2Conn struct {
+	io.ReadCloser
+	w      *io.PipeWriter
+	s      *session
+	cancel context.CancelFunc
+
+	mu                    sync.Mutex
+	readTimer, writeTimer *time.Timer
+	expired               atomic.Bool
+}
+
+func (c *h2Conn) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	if err != nil && c.expired.Load() {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (c *h2Conn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err != nil && c.expired.Load() {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (c *h2Conn) Close() error {
+	c.mu.Lock()
+	for _, t := range []*time.Timer{c.readTimer, c.writeTimer} {
+		if t != nil {
+			t.Stop()
+		}
+	}
+	c.mu.Unlock()
+	c.w.Close()
+	c.cancel()
+	return c.ReadCloser.Close()
+}
+
+func (c *h2Conn) LocalAddr() net.Addr  { return c.s.local }
+func (c *h2Conn) RemoteAddr() net.Addr { return c.s.remote }
+
+// A stream can not be interrupted and resumed, so an expired deadline
+// closes it, and the pending and later calls fail with
+// os.ErrDeadlineExceeded.
+func (c *h2Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *h2Conn) SetReadDeadline(t time.Time) error  { return c.setTimer(&c.readTimer, t) }
+func (c *h2Conn) SetWriteDeadline(t time.Time) error { return c.setTimer(&c.writeTimer, t) }
+
+func (c *h2Conn) setTimer(timer **time.Timer, t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.expired.Load() {
+		return os.ErrDeadlineExceeded
+	}
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	if !t.IsZero() {
+		*timer = time.AfterFunc(time.Until(t), func() {
+			c.expired.Store(true)
+			c.Close()
+		})
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package httpproxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sunshineplan/httpproxy/auth"
+)
+
+// digestProxy serves a proxy accepting CONNECT with Digest credentials of
+// password and echoing the tunnel. A request without credentials is
+// refused on a connection that is then closed, as some proxies do.
+func digestProxy(t *testing.T, password string) (string, *atomic.Int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var conns atomic.Int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					credentials, ok := auth.ParseDigest(req)
+					if !ok || !credentials.Verify(req.Method, password) {
+						resp := &http.Response{StatusCode: http.StatusProxyAuthRequired, ProtoMajor: 1, ProtoMinor: 1, Header: make(http.Header), Close: !ok}
+						resp.Header.Set("Proxy-Authenticate", auth.NewDigestChallenge("proxy", "nonce", "SHA-256", false).String())
+						resp.Write(c)
+						if !ok {
+							return
+						}
+						continue
+					}
+					io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+					io.Copy(c, br)
+					return
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), &conns
+}
+
+func TestChallenge(t *testing.T) {
+	addr, conns := digestProxy(t, "password")
+	d := &Dialer{proxyAddress: addr, Auth: &auth.Digest{Username: "user", Password: "password"}}
+	c, err := d.Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := io.WriteString(c, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "ping" {
+		t.Errorf("expect ping; got %q", b)
+	}
+	if n := conns.Load(); n != 2 {
+		t.Errorf("expect a new connection after the proxy closed it; got %d connections", n)
+	}
+
+	for _, a := range []auth.Authorization{
+		&auth.Digest{Username: "user", Password: "wrong"},
+		auth.Basic{Username: "user", Password: "password"},
+	} {
+		d := &Dialer{proxyAddress: addr, Auth: a}
+		if _, err := d.Dial("tcp", "example.com:80"); err == nil {
+			t.Errorf("%T: expect error; got nil", a)
+		} else if s := StatusError(""); !errors.As(err, &s) || !strings.HasPrefix(err.Error(), "407 ") {
+			t.Errorf("%T: expect 407 status error; got %v", a, err)
+		}
+	}
+}
+
+func TestH2ConnDeadline(t *testing.T) {
+	// the proxy side of the stream is a pair of pipes
+	newConn := func() (*h2Conn, *io.PipeWriter) {
+		rr, rw := io.Pipe()
+		_, ww := io.Pipe()
+		return &h2Conn{ReadCloser: rr, w: ww, s: new(session), cancel: func() {}}, rw
+	}
+	b := make([]byte, 1)
+
+	c, _ := newConn()
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := c.Read(b); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expect read deadline exceeded; got %v", err)
+	}
+	if _, err := c.Write(b); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expect write after expiry to fail; got %v", err)
+	}
+	if err := c.SetDeadline(time.Time{}); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expect expired stream not to be resumed; got %v", err)
+	}
+
+	c, _ = newConn()
+	c.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := c.Write(b); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expect write deadline exceeded; got %v", err)
+	}
+
+	c, _ = newConn()
+	c.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, err := c.Read(b); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expect past deadline exceeded; got %v", err)
+	}
+
+	c, w := newConn()
+	c.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	c.SetDeadline(time.Time{})
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("x"))
+	}()
+	if _, err := c.Read(b); err != nil {
+		t.Errorf("expect cleared deadline not to expire; got %v", err)
+	}
+
+	c, _ = newConn()
+	c.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	c.Close()
+	time.Sleep(100 * time.Millisecond)
+	if _, err := c.Read(b); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("expect deadline stopped by close")
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Host == "forbidden.test:80" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+		rc.Flush()
+		b := make([]byte, 1024)
+		for {
+			n, err := r.Body.Read(b)
+			if n > 0 {
+				w.Write(b[:n])
+				rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}))
+	var conns atomic.Int32
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	config := ts.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	config.ServerName = "127.0.0.1"
+	config.NextProtos = nil
+	d := &Dialer{proxyAddress: ts.Listener.Addr().String(), TLSConfig: config}
+	for i := range 3 {
+		c, err := d.Dial("tcp", "example.com:80")
+		if err != nil {
+			t.Fatalf("#%d %v", i, err)
+		}
+		io.WriteString(c, "ping")
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Errorf("#%d %v", i, err)
+		} else if string(b) != "ping" {
+			t.Errorf("#%d expect ping; got %q", i, b)
+		}
+		defer c.Close()
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("expect tunnels to share one connection; got %d", n)
+	}
+
+	if _, err := d.Dial("tcp", "forbidden.test:80"); err == nil {
+		t.Error("expect error; got nil")
+	} else if s := StatusError(""); !errors.As(err, &s) || !strings.HasPrefix(err.Error(), "403 ") {
+		t.Errorf("expect 403 status error; got %v", err)
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("expect refused stream to keep the connection; got %d connections", n)
+	}
+}
@@ -0,0 +1,142 @@
+// Package masque implements the parts of HTTP Datagrams and the Capsule
+// Protocol (RFC 9297) needed for proxying UDP in HTTP (RFC 9298).
+package masque
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Protocol is the upgrade token and :protocol value of CONNECT-UDP.
+const Protocol = "connect-udp"
+
+// Capsule types.
+const (
+	// Datagram is the DATAGRAM capsule type carrying HTTP Datagrams.
+	Datagram = 0x00
+)
+
+// maxDatagram is the maximum size of a DATAGRAM capsule payload.
+const maxDatagram = 1<<16 + 8
+
+const prefix = "/.well-known/masque/udp/"
+
+// Path returns the default URI template path for the given target.
+func Path(host, port string) string {
+	return prefix + url.PathEscape(host) + "/" + url.PathEscape(port) + "/"
+}
+
+// ParsePath parses the target from a URI template path returned by Path.
+func ParsePath(path string) (string, error) {
+	s, ok := strings.CutPrefix(path, prefix)
+	if !ok {
+		return "", errors.New("masque: bad path: " + path)
+	}
+	host, port, ok := strings.Cut(strings.TrimSuffix(s, "/"), "/")
+	if !ok || host == "" || port == "" || strings.Contains(port, "/") {
+		return "", errors.New("masque: bad path: " + path)
+	}
+	var err error
+	if host, err = url.PathUnescape(host); err != nil {
+		return "", err
+	}
+	if port, err = url.PathUnescape(port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// AppendVarint appends v encoded as a QUIC variable-length integer.
+func AppendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return binary.BigEndian.AppendUint16(b, uint16(v)|0x4000)
+	case v < 1<<30:
+		return binary.BigEndian.AppendUint32(b, uint32(v)|0x80000000)
+	default:
+		return binary.BigEndian.AppendUint64(b, v|0xc000000000000000)
+	}
+}
+
+// ReadVarint reads a QUIC variable-length integer.
+func ReadVarint(r io.ByteReader) (uint64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	n := 1 << (b >> 6)
+	v := uint64(b & 0x3f)
+	for i := 1; i < n; i++ {
+		if b, err = r.ReadByte(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// WriteDatagram writes b as an HTTP Datagram with context ID 0 in a
+// DATAGRAM capsule.
+func WriteDatagram(w io.Writer, b []byte) error {
+	buf := make([]byte, 0, len(b)+10)
+	buf = AppendVarint(buf, Datagram)
+	buf = AppendVarint(buf, uint64(len(b)+1))
+	buf = AppendVarint(buf, 0)
+	_, err := w.Write(append(buf, b...))
+	return err
+}
+
+// ReadDatagram reads capsules until it finds an HTTP Datagram with context
+// ID 0 and returns its payload. Other capsules and contexts are skipped.
+func ReadDatagram(r *bufio.Reader) ([]byte, error) {
+	for {
+		t, err := ReadVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		length, err := ReadVarint(r)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		if t != Datagram {
+			if _, err := io.CopyN(io.Discard, r, int64(min(length, 1<<62))); err != nil {
+				return nil, unexpected(err)
+			}
+			continue
+		}
+		if length > maxDatagram {
+			return nil, errors.New("masque: datagram too large")
+		}
+		b := make([]byte, length)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, unexpected(err)
+		}
+		br := bytes.NewReader(b)
+		id, err := ReadVarint(br)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		if id != 0 {
+			continue
+		}
+		return b[len(b)-br.Len():], nil
+	}
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
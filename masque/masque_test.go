@@ -0,0 +1,129 @@
+package masque
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestVarint(t *testing.T) {
+	// examples of RFC 9000, Appendix A.1
+	for _, testcase := range []struct {
+		hex    string
+		value  uint64
+		encode bool
+	}{
+		{"c2197c5eff14e88c", 151288809941952652, true},
+		{"9d7f3e7d", 494878333, true},
+		{"7bbd", 15293, true},
+		{"25", 37, true},
+		{"4025", 37, false},
+	} {
+		b, _ := hex.DecodeString(testcase.hex)
+		v, err := ReadVarint(bytes.NewReader(b))
+		if err != nil {
+			t.Errorf("%s: %v", testcase.hex, err)
+		} else if v != testcase.value {
+			t.Errorf("%s: expect %d; got %d", testcase.hex, testcase.value, v)
+		}
+		if testcase.encode {
+			if s := hex.EncodeToString(AppendVarint(nil, testcase.value)); s != testcase.hex {
+				t.Errorf("%d: expect %s; got %s", testcase.value, testcase.hex, s)
+			}
+		}
+	}
+	for _, testcase := range []struct {
+		value  uint64
+		length int
+	}{
+		{0, 1}, {63, 1}, {64, 2}, {1<<14 - 1, 2}, {1 << 14, 4}, {1<<30 - 1, 4}, {1 << 30, 8}, {1<<62 - 1, 8},
+	} {
+		b := AppendVarint(nil, testcase.value)
+		if len(b) != testcase.length {
+			t.Errorf("%d: expect %d bytes; got %d", testcase.value, testcase.length, len(b))
+		}
+		if v, err := ReadVarint(bytes.NewReader(b)); err != nil || v != testcase.value {
+			t.Errorf("%d: expect round trip; got %d %v", testcase.value, v, err)
+		}
+	}
+
+	if _, err := ReadVarint(bytes.NewReader(nil)); err != io.EOF {
+		t.Errorf("expect io.EOF; got %v", err)
+	}
+	if _, err := ReadVarint(bytes.NewReader([]byte{0x80, 0x01})); err != io.ErrUnexpectedEOF {
+		t.Errorf("expect io.ErrUnexpectedEOF; got %v", err)
+	}
+}
+
+func TestDatagram(t *testing.T) {
+	var buf bytes.Buffer
+	// an unknown capsule and a datagram of another context are skipped
+	buf.Write(AppendVarint(AppendVarint(nil, 0x2a), 3))
+	buf.WriteString("abc")
+	buf.Write(AppendVarint(AppendVarint(AppendVarint(nil, Datagram), 2), 2))
+	buf.WriteByte('x')
+	if err := WriteDatagram(&buf, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteDatagram(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(&buf)
+	for _, expect := range []string{"hello", ""} {
+		if b, err := ReadDatagram(r); err != nil {
+			t.Fatal(err)
+		} else if string(b) != expect {
+			t.Errorf("expect %q; got %q", expect, b)
+		}
+	}
+	if _, err := ReadDatagram(r); err != io.EOF {
+		t.Errorf("expect io.EOF at the end; got %v", err)
+	}
+
+	for _, testcase := range []struct {
+		name string
+		b    []byte
+	}{
+		{"truncated length", []byte{Datagram}},
+		{"truncated payload", append(AppendVarint(AppendVarint(nil, Datagram), 6), 0, 'a')},
+		{"truncated skipped capsule", append(AppendVarint(AppendVarint(nil, 0x2a), 6), 'a')},
+		{"empty datagram", AppendVarint(AppendVarint(nil, Datagram), 0)},
+	} {
+		if _, err := ReadDatagram(bufio.NewReader(bytes.NewReader(testcase.b))); err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: expect io.ErrUnexpectedEOF; got %v", testcase.name, err)
+		}
+	}
+	b := AppendVarint(AppendVarint(nil, Datagram), maxDatagram+1)
+	if _, err := ReadDatagram(bufio.NewReader(bytes.NewReader(b))); err == nil || errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expect datagram too large; got %v", err)
+	}
+}
+
+func TestPath(t *testing.T) {
+	for _, testcase := range []struct{ host, port, address string }{
+		{"example.com", "443", "example.com:443"},
+		{"192.0.2.1", "53", "192.0.2.1:53"},
+		{"2001:db8::1", "53", "[2001:db8::1]:53"},
+	} {
+		path := Path(testcase.host, testcase.port)
+		if address, err := ParsePath(path); err != nil {
+			t.Errorf("%s: %v", path, err)
+		} else if address != testcase.address {
+			t.Errorf("%s: expect %s; got %s", path, testcase.address, address)
+		}
+	}
+	for _, path := range []string{
+		"/udp/example.com/443/",
+		"/.well-known/masque/udp/example.com/",
+		"/.well-known/masque/udp//443/",
+		"/.well-known/masque/udp/example.com/443/x/",
+		"/.well-known/masque/udp/%zz/443/",
+	} {
+		if _, err := ParsePath(path); err == nil {
+			t.Errorf("%s: expect error", path)
+		}
+	}
+}
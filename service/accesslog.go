@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sunshineplan/utils/log"
+)
+
+// jsonLogger writes one JSON line for every request when it finishes.
+// It is nil unless a JSON access log file is set.
+var jsonLogger *log.Logger
+
+func initJSONLogger(file string) {
+	if file == "" {
+		return
+	}
+	jsonLogger = log.New(file, "", 0)
+	jsonLogger.SetHandler(slog.NewJSONHandler(jsonLogger, nil))
+}
+
+// entry collects what is known about a request until it finishes,
+// including tunnels that outlive the handler.
+type entry struct {
+	start  time.Time
+	remote string
+	method string
+	target string
+
+	mu     sync.Mutex
+	user   user
+	dialer DialerType
+	status int
+
+	in, out atomic.Int64
+	refs    atomic.Int32
+}
+
+func newEntry(remote, method, target string) *entry {
+	e := &entry{start: time.Now(), remote: remote, method: method, target: target}
+	e.refs.Store(1)
+	return e
+}
+
+func (e *entry) hold() { e.refs.Add(1) }
+
+// release logs the entry once the handler and all tunnels are done.
+func (e *entry) release() {
+	if e.refs.Add(-1) != 0 {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	jsonLogger.LogAttrs(context.Background(), slog.LevelInfo, "access",
+		slog.String("user", e.user.name),
+		slog.Bool("whitelist", e.user.whitelist),
+		slog.String("remote", e.remote),
+		slog.String("method", e.method),
+		slog.String("target", e.target),
+		slog.String("dialer", e.dialer.String()),
+		slog.Int("status", e.status),
+		slog.Int64("bytes_in", e.in.Load()),
+		slog.Int64("bytes_out", e.out.Load()),
+		slog.Duration("duration", time.Since(e.start)),
+	)
+}
+
+// logWriter records the response of a request for the JSON access log.
+// Bytes read from the request body or the hijacked connection are
+// counted as bytes in, bytes written to the client as bytes out.
+type logWriter struct {
+	http.ResponseWriter
+	e *entry
+}
+
+// withLog wraps w and r.Body when the JSON access log is enabled.
+// The returned function must be called when the handler returns.
+func withLog(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	if jsonLogger == nil {
+		return w, func() {}
+	}
+	target := r.URL.String()
+	if r.Method == http.MethodConnect && r.URL.Path == "" {
+		target = r.Host
+	}
+	e := newEntry(r.RemoteAddr, r.Method, target)
+	if r.Body != nil {
+		r.Body = countReadCloser{r.Body, &e.in}
+	}
+	return &logWriter{w, e}, e.release
+}
+
+func (w *logWriter) WriteHeader(code int) {
+	w.e.mu.Lock()
+	if w.e.status == 0 {
+		w.e.status = code
+	}
+	w.e.mu.Unlock()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	w.e.mu.Lock()
+	if w.e.status == 0 {
+		w.e.status = http.StatusOK
+	}
+	w.e.mu.Unlock()
+	n, err := w.ResponseWriter.Write(b)
+	w.e.out.Add(int64(n))
+	return n, err
+}
+
+func (w *logWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (w *logWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.e.mu.Lock()
+	if w.e.status == 0 {
+		w.e.status = http.StatusSwitchingProtocols
+	}
+	w.e.mu.Unlock()
+	w.e.hold()
+	brw.Reader = bufio.NewReader(countReadCloser{io.NopCloser(brw.Reader), &w.e.in})
+	return &logConn{Conn: conn, e: w.e}, brw, nil
+}
+
+// setUser records the authenticated user of the request served by w.
+func setUser(w http.ResponseWriter, u user) {
+	if w, ok := w.(*logWriter); ok {
+		w.e.mu.Lock()
+		w.e.user = u
+		w.e.mu.Unlock()
+	}
+}
+
+// setDialer records how the destination of the request served by w is
+// dialed. An untyped dialer is the proxy.
+func setDialer(w http.ResponseWriter, t DialerType) {
+	if t == "" {
+		t = UseProxy
+	}
+	if w, ok := w.(*logWriter); ok {
+		w.e.mu.Lock()
+		w.e.dialer = t
+		w.e.mu.Unlock()
+	}
+}
+
+// logConn is a hijacked client connection that releases its entry on close.
+type logConn struct {
+	net.Conn
+	e    *entry
+	once sync.Once
+}
+
+func (c *logConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.e.in.Add(int64(n))
+	return n, err
+}
+
+func (c *logConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.e.out.Add(int64(n))
+	return n, err
+}
+
+func (c *logConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.e.release)
+	return err
+}
+
+type countReadCloser struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (r countReadCloser) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n.Add(int64(n))
+	return n, err
+}
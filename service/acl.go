@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/sunshineplan/utils/txt"
+)
+
+// denied is the error of a destination refused by the ACL.
+type denied string
+
+func (d denied) Error() string { return "destination not allowed: " + string(d) }
+
+// portRange is an inclusive range of ports.
+type portRange struct{ from, to int }
+
+// parsePorts parses comma-separated ports and ranges such as 443,8000-8999.
+// "*" is every port, which is an empty list.
+func parsePorts(s string) ([]portRange, error) {
+	var ports []portRange
+	for i := range strings.SplitSeq(s, ",") {
+		if i = strings.TrimSpace(i); i == "" || i == "*" {
+			continue
+		}
+		from, to, ok := strings.Cut(i, "-")
+		if !ok {
+			to = from
+		}
+		a, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, errors.New("bad port: " + i)
+		}
+		b, err := strconv.Atoi(to)
+		if err != nil || a < 0 || b > 65535 || a > b {
+			return nil, errors.New("bad port: " + i)
+		}
+		ports = append(ports, portRange{a, b})
+	}
+	return ports, nil
+}
+
+// containsPort reports whether port is in ports. An empty list contains
+// every port.
+func containsPort(ports []portRange, port int) bool {
+	if len(ports) == 0 {
+		return true
+	}
+	for _, i := range ports {
+		if port >= i.from && port <= i.to {
+			return true
+		}
+	}
+	return false
+}
+
+// aclRule allows or denies destinations to users, or to everyone if users
+// is empty.
+type aclRule struct {
+	allow bool
+	any   bool
+	dests *rules
+	ports []portRange
+	users map[string]bool
+}
+
+func (r aclRule) match(u user, host string, ips []net.IP, port int) bool {
+	if len(r.users) > 0 && !r.users[u.name] || !containsPort(r.ports, port) {
+		return false
+	}
+	if r.any || r.dests.match(host) {
+		return true
+	}
+	for _, ip := range ips {
+		if r.dests.match(ip.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseACLRule parses a line of the ACL file:
+//
+//	allow|deny destinations [ports] [@user...]
+//
+// Destinations are comma-separated hosts, *.zones, IPs and CIDRs, or "*".
+func parseACLRule(s string) (rule aclRule, err error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return rule, errors.New("bad ACL rule: " + s)
+	}
+	switch strings.ToLower(fields[0]) {
+	case "allow":
+		rule.allow = true
+	case "deny":
+	default:
+		return rule, errors.New("unknown ACL action: " + fields[0])
+	}
+	if fields[1] == "*" {
+		rule.any = true
+	} else {
+		rule.dests = newRules()
+		rule.dests.addFromString(fields[1])
+		if rule.dests.empty() {
+			return rule, errors.New("bad ACL destination: " + fields[1])
+		}
+	}
+	for _, i := range fields[2:] {
+		if name, ok := strings.CutPrefix(i, "@"); ok {
+			if rule.users == nil {
+				rule.users = make(map[string]bool)
+			}
+			rule.users[name] = true
+		} else if rule.ports != nil {
+			return rule, errors.New("bad ACL rule: " + s)
+		} else if rule.ports, err = parsePorts(i); err != nil {
+			return
+		} else if rule.ports == nil {
+			rule.ports = []portRange{}
+		}
+	}
+	return
+}
+
+// ACL decides which destinations users of the server may reach. Rules are
+// matched in order and the first match decides. Without a match, CONNECT
+// tunnels are limited to connectPorts, and loopback, private, link-local
+// and other internal addresses are denied.
+type ACL struct {
+	mu           sync.RWMutex
+	rules        []aclRule
+	connectPorts []portRange
+}
+
+// NewACL returns an ACL with only the default policy.
+func NewACL(connectPorts []portRange) *ACL {
+	return &ACL{connectPorts: connectPorts}
+}
+
+func (a *ACL) setRules(rows []string) {
+	var rules []aclRule
+	for _, row := range rows {
+		if i := strings.IndexRune(row, '#'); i != -1 {
+			row = row[:i]
+		}
+		if strings.TrimSpace(row) == "" {
+			continue
+		}
+		rule, err := parseACLRule(row)
+		if err != nil {
+			errorLogger.Print(err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	a.mu.Lock()
+	a.rules = rules
+	a.mu.Unlock()
+	accessLogger.Printf("loaded %d ACL rules", len(rules))
+}
+
+func initACL(file string, connectPorts []portRange) *ACL {
+	a := NewACL(connectPorts)
+	if file == "" {
+		return a
+	}
+	accessLogger.Debug("acl: " + file)
+	if rows, err := txt.ReadFile(file); err != nil {
+		errorLogger.Println("failed to load ACL file:", err)
+	} else {
+		a.setRules(rows)
+	}
+	if err := watchFile(
+		file,
+		func() {
+			if rows, err := txt.ReadFile(file); err != nil {
+				errorLogger.Print(err)
+			} else {
+				a.setRules(rows)
+			}
+		},
+		func() { a.setRules(nil) },
+	); err != nil {
+		errorLogger.Print(err)
+	}
+	return a
+}
+
+// specialPrefixes are the special-purpose ranges of the IANA registries
+// that are not globally reachable, see RFC 6890, and multicast.
+var specialPrefixes = func() (prefixes []netip.Prefix) {
+	for _, s := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.0.0.0/24",
+		"192.0.2.0/24",
+		"192.88.99.0/24",
+		"192.168.0.0/16",
+		"198.18.0.0/15",
+		"198.51.100.0/24",
+		"203.0.113.0/24",
+		"224.0.0.0/4",
+		"240.0.0.0/4",
+		"::/128",
+		"::1/128",
+		"64:ff9b:1::/48",
+		"100::/64",
+		"2001::/23",
+		"2001:db8::/32",
+		"fc00::/7",
+		"fe80::/10",
+		"fec0::/10",
+		"ff00::/8",
+	} {
+		prefixes = append(prefixes, netip.MustParsePrefix(s))
+	}
+	return
+}()
+
+// The IPv6 prefixes of NAT64 (RFC 6052) and 6to4 (RFC 3056), whose
+// addresses embed an IPv4 address.
+var (
+	nat64Prefix     = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFourPrefix = netip.MustParsePrefix("2002::/16")
+)
+
+// isInternal reports whether ip is not a public unicast address. The IPv4
+// address embedded in a NAT64 or 6to4 address is checked instead of it.
+func isInternal(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return true
+	}
+	addr = addr.Unmap()
+	if b := addr.As16(); nat64Prefix.Contains(addr) {
+		addr = netip.AddrFrom4([4]byte(b[12:]))
+	} else if sixToFourPrefix.Contains(addr) {
+		addr = netip.AddrFrom4([4]byte(b[2:6]))
+	}
+	for _, prefix := range specialPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns a denied error if u may not reach address. connect is
+// whether the destination is a CONNECT tunnel. The returned context makes
+// direct dials check the addresses they connect to as well, unless a rule
+// allows the destination by name.
+func (a *ACL) check(ctx context.Context, u user, address string, connect bool) (context.Context, error) {
+	host, p, err := net.SplitHostPort(address)
+	if err != nil {
+		return ctx, denied("bad address " + address)
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return ctx, denied("bad port " + p)
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if ips, err = resolveIP(host); err != nil {
+		// unresolvable destinations fail to dial anyway
+		ips = nil
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, rule := range a.rules {
+		if rule.match(u, host, ips, port) {
+			if !rule.allow {
+				return ctx, denied("rule")
+			}
+			return ctx, nil
+		}
+	}
+	if connect && !containsPort(a.connectPorts, port) {
+		return ctx, denied("port " + p)
+	}
+	for _, ip := range ips {
+		if isInternal(ip) {
+			return ctx, denied("internal address " + ip.String())
+		}
+	}
+	return context.WithValue(ctx, dialCheckKey{}, func(ip net.IP) error { return a.checkIP(u, ip, port) }), nil
+}
+
+// checkIP checks the address a direct dial connects to, which may differ
+// from what check resolved.
+func (a *ACL) checkIP(u user, ip net.IP, port int) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, rule := range a.rules {
+		if rule.match(u, ip.String(), nil, port) {
+			if !rule.allow {
+				return denied("rule")
+			}
+			return nil
+		}
+	}
+	if isInternal(ip) {
+		return denied("internal address " + ip.String())
+	}
+	return nil
+}
+
+type dialCheckKey struct{}
+
+// dialControl returns the control function checking the addresses dialed
+// with ctx, if it has one.
+func dialControl(ctx context.Context) func(string, string, syscall.RawConn) error {
+	check, ok := ctx.Value(dialCheckKey{}).(func(net.IP) error)
+	if !ok {
+		return nil
+	}
+	return func(_, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return denied("bad address " + address)
+		}
+		return check(ip)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/sunshineplan/httpproxy/auth"
+	"github.com/sunshineplan/utils/httpsvr"
+	"github.com/sunshineplan/utils/txt"
+)
+
+type Admin struct {
+	*httpsvr.Server
+	base      *Base
+	token     string
+	secrets   string
+	whitelist string
+
+	mu sync.Mutex
+}
+
+type accountInfo struct {
+	Username string  `json:"username"`
+	Password *string `json:"password,omitempty"`
+	Hash     string  `json:"hash,omitempty"`
+	Hashed   bool    `json:"hashed"`
+	Limit    *string `json:"limit,omitempty"`
+}
+
+type whitelistInfo struct {
+	Address string  `json:"address"`
+	Limit   *string `json:"limit,omitempty"`
+}
+
+type usageInfo struct {
+	User          string `json:"user"`
+	Whitelist     bool   `json:"whitelist"`
+	Today         int64  `json:"today"`
+	Weekly        int64  `json:"weekly"`
+	Monthly       int64  `json:"monthly"`
+	Total         int64  `json:"total"`
+	UploadToday   int64  `json:"upload_today"`
+	UploadWeekly  int64  `json:"upload_weekly"`
+	UploadMonthly int64  `json:"upload_monthly"`
+	UploadTotal   int64  `json:"upload_total"`
+	Active        int64  `json:"active"`
+}
+
+func NewAdmin(base *Base, port, token, secrets, whitelist string) *Admin {
+	a := &Admin{Server: httpsvr.New(), base: base, token: token, secrets: secrets, whitelist: whitelist}
+	a.Host = base.Host
+	a.Port = port
+	a.ErrorLog = errorLogger.Logger
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /accounts", a.listAccounts)
+	mux.HandleFunc("POST /accounts", a.addAccount)
+	mux.HandleFunc("PUT /accounts/{username}", a.updateAccount)
+	mux.HandleFunc("DELETE /accounts/{username}", a.removeAccount)
+	mux.HandleFunc("GET /whitelist", a.listWhitelist)
+	mux.HandleFunc("POST /whitelist", a.addWhitelist)
+	mux.HandleFunc("PUT /whitelist/{address...}", a.updateWhitelist)
+	mux.HandleFunc("DELETE /whitelist/{address...}", a.removeWhitelist)
+	mux.HandleFunc("GET /usage", a.listUsage)
+	mux.HandleFunc("GET /usage/history", a.usageHistory)
+	mux.HandleFunc("POST /usage/reset", a.resetUsage)
+	mux.HandleFunc("POST /record", a.saveRecord)
+	a.Handler = a.authenticate(mux)
+	return a
+}
+
+func (a *Admin) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			authFailed.Do(func() { errorLogger.Printf("%s Admin Authentication Failed", r.RemoteAddr) })
+			w.Header().Set("WWW-Authenticate", `Bearer realm="HTTP(S) Proxy Admin"`)
+			jsonError(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func jsonError(w http.ResponseWriter, error string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": error})
+}
+
+// rewrite replaces the rows of file whose key equals name with line, or
+// removes them if line is empty. The line is appended if no row matches.
+// The file is written atomically and reloaded by its watcher.
+func rewrite(file, name, line string, key func(string) string) error {
+	rows, err := txt.ReadFile(file)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	var b strings.Builder
+	var found bool
+	for _, row := range rows {
+		s := row
+		if i := strings.IndexRune(s, '#'); i != -1 {
+			s = s[:i]
+		}
+		if fields := strings.Fields(s); len(fields) > 0 && key(fields[0]) == name {
+			if !found && line != "" {
+				b.WriteString(line + "\n")
+			}
+			found = true
+			continue
+		}
+		b.WriteString(row + "\n")
+	}
+	if !found && line != "" {
+		b.WriteString(line + "\n")
+	}
+	return writeFile(file, []byte(b.String()))
+}
+
+func accountKey(field string) string {
+	username, _, _ := strings.Cut(field, ":")
+	return username
+}
+
+func whitelistKey(field string) string { return field }
+
+func accountLine(account auth.Basic, limit string) string {
+	if limit == "" {
+		return account.Username + ":" + account.Password
+	}
+	return account.Username + ":" + account.Password + " " + limit
+}
+
+// validField reports whether s can be written as a field of a row of the
+// secrets file, which is split at whitespace and cut at '#'.
+func validField(s string) bool {
+	return s != "" && !strings.ContainsFunc(s, func(r rune) bool {
+		return r == '#' || unicode.IsSpace(r) || unicode.IsControl(r)
+	})
+}
+
+func whitelistLine(allow allow, limit string) string {
+	if limit == "" {
+		return string(allow)
+	}
+	return string(allow) + " " + limit
+}
+
+func (a *Admin) listAccounts(w http.ResponseWriter, _ *http.Request) {
+	res := []accountInfo{}
+	a.base.accounts.Range(func(account auth.Basic, limit *limit) bool {
+		s := limit.String()
+		res = append(res, accountInfo{Username: account.Username, Hashed: isHashed(account.Password), Limit: &s})
+		return true
+	})
+	writeJSON(w, res)
+}
+
+// secret returns the password to store for info, hashed if requested.
+func (info accountInfo) secret() (string, error) {
+	if info.Password == nil || *info.Password == "" {
+		return "", errors.New("password is required")
+	}
+	if info.Hash == "" {
+		if !validField(*info.Password) {
+			return "", errors.New("invalid password")
+		}
+		return *info.Password, nil
+	}
+	return hashPassword(info.Hash, *info.Password)
+}
+
+func (a *Admin) addAccount(w http.ResponseWriter, r *http.Request) {
+	var info accountInfo
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validField(info.Username) || strings.ContainsRune(info.Username, ':') {
+		jsonError(w, "invalid username", http.StatusBadRequest)
+		return
+	}
+	a.storeAccount(w, info, false)
+}
+
+func (a *Admin) updateAccount(w http.ResponseWriter, r *http.Request) {
+	var info accountInfo
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	info.Username = r.PathValue("username")
+	a.storeAccount(w, info, true)
+}
+
+func (a *Admin) storeAccount(w http.ResponseWriter, info accountInfo, update bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	old, oldLimit, found := a.base.lookup(info.Username)
+	if found != update {
+		if update {
+			jsonError(w, "account not found", http.StatusNotFound)
+		} else {
+			jsonError(w, "account already exists", http.StatusConflict)
+		}
+		return
+	}
+	account := auth.Basic{Username: info.Username, Password: old.Password}
+	if !update || info.Password != nil {
+		secret, err := info.secret()
+		if err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		account.Password = secret
+	}
+	var s string
+	if info.Limit != nil {
+		s = strings.TrimSpace(*info.Limit)
+	} else if oldLimit != nil {
+		s = oldLimit.String()
+	}
+	limit, err := parseLimit(s)
+	if err != nil {
+		jsonError(w, "invalid limit: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := rewrite(a.secrets, account.Username, accountLine(account, s), accountKey); err != nil {
+		errorLogger.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if found {
+		a.base.accounts.Delete(old)
+	}
+	a.base.accounts.Store(account, limit)
+	accessLogger.Printf("[admin] account %s stored", account.Username)
+	if update {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (a *Admin) removeAccount(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	username := r.PathValue("username")
+	account, _, found := a.base.lookup(username)
+	if !found {
+		jsonError(w, "account not found", http.StatusNotFound)
+		return
+	}
+	if err := rewrite(a.secrets, username, "", accountKey); err != nil {
+		errorLogger.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.base.accounts.Delete(account)
+	accessLogger.Printf("[admin] account %s removed", username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) listWhitelist(w http.ResponseWriter, _ *http.Request) {
+	res := []whitelistInfo{}
+	a.base.whitelist.Range(func(allow allow, limit *limit) bool {
+		s := limit.String()
+		res = append(res, whitelistInfo{Address: string(allow), Limit: &s})
+		return true
+	})
+	writeJSON(w, res)
+}
+
+func (a *Admin) addWhitelist(w http.ResponseWriter, r *http.Request) {
+	var info whitelistInfo
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.storeWhitelist(w, info, false)
+}
+
+func (a *Admin) updateWhitelist(w http.ResponseWriter, r *http.Request) {
+	var info whitelistInfo
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	info.Address = r.PathValue("address")
+	a.storeWhitelist(w, info, true)
+}
+
+func (a *Admin) storeWhitelist(w http.ResponseWriter, info whitelistInfo, update bool) {
+	allow := allow(info.Address)
+	if !allow.isValid() {
+		jsonError(w, "invalid address", http.StatusBadRequest)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	oldLimit, found := a.base.whitelist.Load(allow)
+	if found != update {
+		if update {
+			jsonError(w, "whitelist record not found", http.StatusNotFound)
+		} else {
+			jsonError(w, "whitelist record already exists", http.StatusConflict)
+		}
+		return
+	}
+	var s string
+	if info.Limit != nil {
+		s = strings.TrimSpace(*info.Limit)
+	} else if found {
+		s = oldLimit.String()
+	}
+	limit, err := parseLimit(s)
+	if err != nil {
+		jsonError(w, "invalid limit: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := rewrite(a.whitelist, string(allow), whitelistLine(allow, s), whitelistKey); err != nil {
+		errorLogger.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.base.whitelist.Store(allow, limit)
+	accessLogger.Printf("[admin] whitelist record %s stored", allow)
+	if update {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (a *Admin) removeWhitelist(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	allow := allow(r.PathValue("address"))
+	if _, found := a.base.whitelist.Load(allow); !found {
+		jsonError(w, "whitelist record not found", http.StatusNotFound)
+		return
+	}
+	if err := rewrite(a.whitelist, string(allow), "", whitelistKey); err != nil {
+		errorLogger.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.base.whitelist.Delete(allow)
+	accessLogger.Printf("[admin] whitelist record %s removed", allow)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) listUsage(w http.ResponseWriter, _ *http.Request) {
+	res := []usageInfo{}
+	recordMap.Range(func(u user, v *record) bool {
+		res = append(res, usageInfo{
+			u.name, u.whitelist,
+			v.download.today.Get(), v.download.weekly.Get(), v.download.monthly.Get(), v.download.total.Get(),
+			v.upload.today.Get(), v.upload.weekly.Get(), v.upload.monthly.Get(), v.upload.total.Get(),
+			v.active.Load(),
+		})
+		return true
+	})
+	writeJSON(w, res)
+}
+
+func (a *Admin) usageHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	v, ok := recordMap.Load(user{query.Get("user"), query.Get("whitelist") == "true"})
+	if !ok {
+		jsonError(w, "record not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, v.days())
+}
+
+func (a *Admin) resetUsage(w http.ResponseWriter, r *http.Request) {
+	var info struct {
+		User      string `json:"user"`
+		Whitelist bool   `json:"whitelist"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var n int
+	recordMap.Range(func(u user, v *record) bool {
+		if info.User == "" || u == (user{info.User, info.Whitelist}) {
+			v.reset()
+			n++
+		}
+		return true
+	})
+	if info.User != "" && n == 0 {
+		jsonError(w, "record not found", http.StatusNotFound)
+		return
+	}
+	accessLogger.Printf("[admin] %d usage records reset", n)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) saveRecord(w http.ResponseWriter, _ *http.Request) {
+	if err := saveRecord(a.base); err != nil {
+		errorLogger.Println("failed to save records:", err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
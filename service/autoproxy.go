@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -11,26 +12,42 @@ import (
 	"sync"
 	"time"
 
+	"github.com/sunshineplan/utils/container"
 	"github.com/sunshineplan/utils/httpsvr"
 	"github.com/sunshineplan/utils/retry"
-	"github.com/sunshineplan/utils/txt"
 	"golang.org/x/net/proxy"
 )
 
 type Autoproxy struct {
 	sync.RWMutex
 	*httpsvr.Server
-	*proxy.PerHost
+	routes  []route
+	dialers map[DialerType]proxy.Dialer
 }
 
-const autoproxyURL = "https://raw.githubusercontent.com/v2fly/domain-list-community/release/geolocation-!cn.txt"
+const (
+	autoproxyURL = "https://raw.githubusercontent.com/v2fly/domain-list-community/release/geolocation-!cn.txt"
+	// included lists are read from the source of domain-list-community
+	autoproxyDataURL = "https://raw.githubusercontent.com/v2fly/domain-list-community/master/data/"
+)
 
 var (
-	last            string
-	customAutoproxy []byte
+	customAutoproxy   []byte
+	autoproxyFilter   = attrFilter{exclude: []string{"cn"}}
+	autoproxyInterval = 24 * time.Hour
+	includeList       func(name string) (string, error)
+	includeCache      = container.NewMap[string, string]()
 )
 
-func getAutoproxy(ctx context.Context, proxy *url.URL, c chan<- string) {
+// fetchResult is the response to a fetch of an autoproxy list.
+type fetchResult struct {
+	body         string
+	etag         string
+	lastModified string
+	notModified  bool
+}
+
+func getAutoproxy(ctx context.Context, target string, entry cacheEntry, proxy *url.URL, c chan<- fetchResult) {
 	mode := "default"
 	client := http.DefaultClient
 	if proxy == nil {
@@ -54,11 +71,17 @@ func getAutoproxy(ctx context.Context, proxy *url.URL, c chan<- string) {
 			client = &http.Client{Transport: &http.Transport{Proxy: nil}}
 		}
 	}
-	req, err := http.NewRequestWithContext(ctx, "GET", autoproxyURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
 	if err != nil {
 		errorLogger.Print(err)
 		return
 	}
+	if entry.ETag != "" {
+		req.Header.Set("If-None-Match", entry.ETag)
+	}
+	if entry.LastModified != "" {
+		req.Header.Set("If-Modified-Since", entry.LastModified)
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		if !errors.Is(err, context.Canceled) {
@@ -67,6 +90,13 @@ func getAutoproxy(ctx context.Context, proxy *url.URL, c chan<- string) {
 		return
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && (entry.ETag != "" || entry.LastModified != "") {
+		select {
+		case c <- fetchResult{notModified: true}:
+		default:
+		}
+		return
+	}
 	if resp.StatusCode != http.StatusOK {
 		errorLogger.Println(mode, resp.StatusCode)
 		return
@@ -79,120 +109,200 @@ func getAutoproxy(ctx context.Context, proxy *url.URL, c chan<- string) {
 		return
 	}
 	select {
-	case c <- string(b):
+	case c <- fetchResult{string(b), resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), false}:
 	default:
 	}
 }
 
-func fetchAutoproxy(c *Client) (string, error) {
-	accessLogger.Print("fetch autoproxy")
+// fetch gets target directly, through the proxy and as the environment
+// decides at the same time, and returns the first response. The request
+// is conditional if entry has validators.
+func fetch(c *Client, target string, entry cacheEntry) (fetchResult, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
-	ch := make(chan string)
-	go getAutoproxy(ctx, nil, ch)
-	go getAutoproxy(ctx, c.u, ch)
-	go getAutoproxy(ctx, new(url.URL), ch)
+	ch := make(chan fetchResult)
+	go getAutoproxy(ctx, target, entry, nil, ch)
+	go getAutoproxy(ctx, target, entry, c.proxy.url(), ch)
+	go getAutoproxy(ctx, target, entry, new(url.URL), ch)
 	select {
 	case <-ctx.Done():
-		return "", errors.New("failed to check autoproxy")
-	case b := <-ch:
+		return fetchResult{}, errors.New("failed to fetch " + target)
+	case res := <-ch:
 		cancel()
-		accessLogger.Print("autoproxy fetched")
-		return string(b), nil
+		return res, nil
 	}
 }
 
-func addPerHost(p *proxy.PerHost, s string, custom bool) *proxy.PerHost {
-	if custom {
-		p.AddFromString(s)
-	} else {
-		if res, err := txt.ReadAll(strings.NewReader(s)); err != nil {
-			errorLogger.Print(err)
+// fetchInclude returns the named list of domain-list-community, which is
+// fetched once until the autoproxy list is updated. A copy cached within
+// the refresh interval is used without fetching, and an older copy if the
+// fetch fails.
+func fetchInclude(c *Client, name string) (string, error) {
+	if s, ok := includeCache.Load(name); ok {
+		return s, nil
+	}
+	target := autoproxyDataURL + url.PathEscape(name)
+	cached, entry, ok := loadCache(target)
+	if !ok || time.Since(entry.Fetched) >= autoproxyInterval {
+		accessLogger.Print("fetch autoproxy include: " + name)
+		s, err := fetchCached(c, target)
+		if err == nil {
+			cached, ok = s, true
+		} else if !ok {
+			return "", err
 		} else {
-			for _, i := range res {
-				if strings.HasSuffix(i, "@cn") {
-					continue
-				}
-				i = strings.ReplaceAll(i, ":@ads", "")
-				switch {
-				case strings.HasPrefix(i, "domain:"):
-					p.AddZone(strings.TrimPrefix(i, "domain:"))
-				case strings.HasPrefix(i, "full:"):
-					p.AddHost(strings.TrimPrefix(i, "full:"))
-				}
-			}
+			errorLogger.Printf("failed to fetch autoproxy include %s, use cache: %s", name, err)
 		}
 	}
-	return p
+	includeCache.Store(name, cached)
+	return cached, nil
 }
 
-func parseAutoproxy(p *proxy.PerHost, s, custom string) *proxy.PerHost {
-	addPerHost(p, s, false)
-	addPerHost(p, custom, true)
-	return p
+// parseCustom parses the custom file. Its lines are either domain list
+// rules or comma-separated values as in [proxy.PerHost.AddFromString].
+func parseCustom(s string) *rules {
+	r := newRules()
+	l := &domainList{r, includeList}
+	for line := range strings.Lines(s) {
+		if kind, _, ok := strings.Cut(strings.TrimSpace(line), ":"); ok && isDomainRuleKind(kind) {
+			l.add(line, attrFilter{})
+		} else if line, _, _ = strings.Cut(line, "#"); strings.TrimSpace(line) != "" {
+			r.addFromString(line)
+		}
+	}
+	return r
 }
 
-func initAutoproxy(c *Client) *proxy.PerHost {
-	var err error
+// update replaces the routes used by the autoproxy listener and its PAC file.
+func (a *Autoproxy) update(routes []route) {
+	a.Lock()
+	defer a.Unlock()
+	a.routes = routes
+}
+
+// Dial connects to address through the outbound of the first route
+// matching its host, or directly if none matches. The host is resolved
+// before it is sent to the outbound if the route resolves names locally,
+// and its addresses are tried in turn.
+func (a *Autoproxy) Dial(network, address string) (net.Conn, error) {
+	return a.dialHost(network, address, "")
+}
+
+// dialHost dials address as Dial does, but routes it by host if host is
+// not empty, such as a server name sniffed from a connection to an address.
+func (a *Autoproxy) dialHost(network, address, host string) (net.Conn, error) {
+	h, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		host = h
+	}
+	r, ok := lookupRoute(a.routes, host)
+	if !ok {
+		r.outbound = UseDirect
+	}
+	d, ok := a.dialers[r.outbound]
+	if !ok {
+		d = a.dialers[UseDirect]
+	}
+	if r.local && net.ParseIP(h) == nil {
+		ips, err := resolveIP(h)
+		if err != nil {
+			return nil, err
+		} else if len(ips) == 0 {
+			return nil, errors.New("no address for " + h)
+		}
+		for _, ip := range ips {
+			var conn net.Conn
+			if conn, err = d.Dial(network, net.JoinHostPort(ip.String(), port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+	return d.Dial(network, address)
+}
+
+func initAutoproxy(c *Client, sources []*source) []route {
 	accessLogger.Debug("autoproxy: " + *autoproxy)
-	if err = retry.Do(func() (err error) {
-		last, err = fetchAutoproxy(c)
-		return
-	}, 3, 0); err != nil {
-		errorLogger.Print(err)
+	includeList = func(name string) (string, error) { return fetchInclude(c, name) }
+	reload := func() {
+		c.autoproxy.update(buildRoutes(parseCustom(string(customAutoproxy)), sources))
+	}
+	for _, s := range sources {
+		accessLogger.Debug("autoproxy source: " + s.location)
+		if !s.isURL() {
+			if _, err := s.refresh(c); err != nil {
+				errorLogger.Printf("failed to load autoproxy source %s: %s", s.location, err)
+			}
+			if err := watchFile(
+				s.location,
+				func() {
+					if _, err := s.refresh(c); err != nil {
+						errorLogger.Print(err)
+						return
+					}
+					reload()
+				},
+				func() {
+					s.set("")
+					reload()
+				},
+			); err != nil {
+				errorLogger.Print(err)
+			}
+			continue
+		}
+		next := s.interval
+		if fetched, ok := s.loadCache(); ok {
+			accessLogger.Printf("autoproxy source %s loaded from cache", s.location)
+			next = max(s.interval-time.Since(fetched), 0)
+		} else if err := retry.Do(func() error {
+			_, err := s.refresh(c)
+			return err
+		}, 3, 0); err != nil {
+			errorLogger.Printf("failed to load autoproxy source %s: %s", s.location, err)
+		}
+		go func() {
+			t := time.NewTimer(next)
+			for range t.C {
+				t.Reset(s.interval)
+				changed, err := s.refresh(c)
+				if err != nil {
+					errorLogger.Printf("failed to update autoproxy source %s: %s", s.location, err)
+					continue
+				}
+				if !changed {
+					accessLogger.Printf("autoproxy source %s: no update available", s.location)
+					continue
+				}
+				accessLogger.Printf("autoproxy source %s updated", s.location)
+				if s.format == formatV2fly {
+					includeCache.Clear()
+				}
+				reload()
+			}
+		}()
 	}
 	accessLogger.Debug("custom autoproxy: " + *custom)
+	var err error
 	customAutoproxy, err = os.ReadFile(*custom)
 	if err != nil {
 		errorLogger.Println("failed to load custom autoproxy file:", err)
 	}
-	p := parseAutoproxy(proxy.NewPerHost(
-		&Dialer{UseDirect, proxy.Direct},
-		&Dialer{UseProxy, c.proxy},
-	), last, string(customAutoproxy))
-	go func() {
-		t := time.NewTicker(24 * time.Hour)
-		for range t.C {
-			s, err := fetchAutoproxy(c)
-			if err != nil {
-				errorLogger.Print(err)
-				continue
-			}
-			if s == last {
-				accessLogger.Print("autoproxy: no update available")
-				continue
-			}
-			last = s
-			c.autoproxy.Lock()
-			c.autoproxy.PerHost = parseAutoproxy(proxy.NewPerHost(
-				&Dialer{UseDirect, proxy.Direct},
-				&Dialer{UseProxy, c.proxy},
-			), s, string(customAutoproxy))
-			c.autoproxy.Unlock()
-		}
-	}()
 	if err := watchFile(
 		*custom,
 		func() {
-			c.autoproxy.Lock()
-			defer c.autoproxy.Unlock()
 			customAutoproxy, _ = os.ReadFile(*custom)
-			c.autoproxy.PerHost = parseAutoproxy(proxy.NewPerHost(
-				&Dialer{UseDirect, proxy.Direct},
-				&Dialer{UseProxy, c.proxy},
-			), last, string(customAutoproxy))
+			reload()
 		},
 		func() {
-			c.autoproxy.Lock()
-			defer c.autoproxy.Unlock()
 			customAutoproxy = nil
-			c.autoproxy.PerHost = addPerHost(proxy.NewPerHost(
-				&Dialer{UseDirect, proxy.Direct},
-				&Dialer{UseProxy, c.proxy},
-			), last, false)
+			reload()
 		},
 	); err != nil {
 		errorLogger.Print(err)
 	}
-	return p
+	return buildRoutes(parseCustom(string(customAutoproxy)), sources)
 }
@@ -13,6 +13,7 @@ type Base struct {
 	*httpsvr.Server
 	accounts  *container.Map[auth.Basic, *limit]
 	whitelist *container.Map[allow, *limit]
+	digest    bool
 }
 
 func NewBase(host, port string) *Base {
@@ -26,6 +27,11 @@ func NewBase(host, port string) *Base {
 	return base
 }
 
+func (base *Base) SetDigest(digest bool) *Base {
+	base.digest = digest
+	return base
+}
+
 func (base *Base) hasAccount() bool {
 	var found bool
 	base.accounts.Range(func(_ auth.Basic, _ *limit) bool {
@@ -60,10 +66,23 @@ func (base *Base) isAllow(remoteAddr string) (found bool, a allow, exceeded bool
 	return
 }
 
+// lookup finds the account with the given username. Its password is the
+// stored secret, either plaintext or a hash.
+func (base *Base) lookup(username string) (account auth.Basic, l *limit, found bool) {
+	base.accounts.Range(func(a auth.Basic, limit *limit) bool {
+		if a.Username == username {
+			account, l, found = a, limit, true
+			return false
+		}
+		return true
+	})
+	return
+}
+
 func (base *Base) checkAccount(auth auth.Basic) (found bool, exceeded bool, limit *limit) {
-	if limit, ok := base.accounts.Load(auth); !ok {
+	if account, limit, ok := base.lookup(auth.Username); !ok || !verifyPassword(account.Password, auth.Password) {
 		return false, false, nil
-	} else if limit.daily == 0 && limit.monthly == 0 {
+	} else if !limit.hasQuota() {
 		return true, false, limit
 	} else if v, ok := recordMap.Load(user{auth.Username, false}); ok {
 		return true, limit.isExceeded(v), limit
@@ -77,6 +96,19 @@ type user struct {
 	whitelist bool
 }
 
+// enter takes a connection of u within the caps of l, answering 429 Too
+// Many Requests if u is over a cap.
+func (base *Base) enter(w http.ResponseWriter, remoteAddr string, u user, l *limit) bool {
+	if reason, ok := enter(u, l); !ok {
+		logOverCap(remoteAddr, u, l, reason)
+		http.Error(w, reason, http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// Auth authenticates the request and takes a connection of its user,
+// which the caller gives back by leave.
 func (base *Base) Auth(w http.ResponseWriter, r *http.Request) (user, *limiter.Limiter, bool) {
 	switch hasWhitelist, hasAccount := base.hasWhitelist(), base.hasAccount(); {
 	case !hasWhitelist && !hasAccount:
@@ -84,33 +116,47 @@ func (base *Base) Auth(w http.ResponseWriter, r *http.Request) (user, *limiter.L
 	case hasWhitelist:
 		if found, allow, exceeded, limit := base.isAllow(r.RemoteAddr); found {
 			if exceeded {
+				metrics.limitExceeded.Add(1)
 				limit.st.Do(func() { accessLogger.Printf("%s[%s] Exceeded traffic limit", r.RemoteAddr, allow) })
 				http.Error(w, "exceeded traffic limit", http.StatusForbidden)
 				return user{}, nil, false
 			}
-			return user{string(allow), true}, limit.speed, true
+			u := user{string(allow), true}
+			if !base.enter(w, r.RemoteAddr, u, limit) {
+				return user{}, nil, false
+			}
+			return u, limit.speed, true
 		}
 		fallthrough
 	case hasAccount:
-		auth, ok := auth.ParseBasic(r)
+		auth, ok, stale := base.credentials(r)
 		if !ok {
+			metrics.authRequired.Add(1)
 			authRequired.Do(func() { accessLogger.Printf("%s Proxy Authentication Required", r.RemoteAddr) })
-			w.Header().Add("Proxy-Authenticate", `Basic realm="HTTP(S) Proxy Server"`)
+			base.challenge(w, stale)
 			http.Error(w, "", http.StatusProxyAuthRequired)
 			return user{}, nil, false
 		} else if found, exceeded, limit := base.checkAccount(auth); !found {
+			metrics.authFailed.Add(1)
+			metrics.authRequired.Add(1)
 			authFailed.Do(func() { errorLogger.Printf("%s Proxy Authentication Failed", r.RemoteAddr) })
-			w.Header().Add("Proxy-Authenticate", `Basic realm="HTTP(S) Proxy Server"`)
+			base.challenge(w, false)
 			http.Error(w, "", http.StatusProxyAuthRequired)
 			return user{}, nil, false
 		} else if found && exceeded {
+			metrics.limitExceeded.Add(1)
 			limit.st.Do(func() { accessLogger.Printf("%s[%s] Exceeded traffic limit", r.RemoteAddr, auth.Username) })
 			http.Error(w, "exceeded traffic limit", http.StatusForbidden)
 			return user{}, nil, false
 		} else {
-			return user{auth.Username, false}, limit.speed, true
+			u := user{auth.Username, false}
+			if !base.enter(w, r.RemoteAddr, u, limit) {
+				return user{}, nil, false
+			}
+			return u, limit.speed, true
 		}
 	default:
+		metrics.notAllowed.Add(1)
 		notAllow.Do(func() { accessLogger.Printf("%s not allow", r.RemoteAddr) })
 		http.Error(w, "access not allow", http.StatusForbidden)
 		return user{}, nil, false
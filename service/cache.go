@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// autoproxyCache is the directory where fetched autoproxy lists are kept
+// between runs. Nothing is cached if it is empty.
+var autoproxyCache string
+
+// cacheEntry describes a cached list and how to revalidate it.
+type cacheEntry struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+func cachePath(target string) string {
+	sum := sha256.Sum256([]byte(target))
+	return filepath.Join(autoproxyCache, hex.EncodeToString(sum[:8]))
+}
+
+// loadCache returns the cached content of target.
+func loadCache(target string) (content string, entry cacheEntry, ok bool) {
+	if autoproxyCache == "" {
+		return
+	}
+	path := cachePath(target)
+	b, err := os.ReadFile(path + ".json")
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(b, &entry); err != nil || entry.URL != target {
+		return
+	}
+	b, err = os.ReadFile(path + ".txt")
+	if err != nil {
+		return
+	}
+	return string(b), entry, true
+}
+
+// saveCache saves the content of target and its entry. An empty content
+// only updates the entry of a revalidated list. The entry is written last,
+// so its validators never belong to content older than the cached one.
+func saveCache(target, content string, entry cacheEntry) {
+	if autoproxyCache == "" {
+		return
+	}
+	if err := os.MkdirAll(autoproxyCache, 0755); err != nil {
+		errorLogger.Print(err)
+		return
+	}
+	path := cachePath(target)
+	if content != "" {
+		if err := writeFile(path+".txt", []byte(content)); err != nil {
+			errorLogger.Print(err)
+			return
+		}
+	}
+	b, _ := json.Marshal(entry)
+	if err := writeFile(path+".json", b); err != nil {
+		errorLogger.Print(err)
+	}
+}
+
+// fetchCached fetches target with a conditional request against the
+// cached copy, and caches what it gets. It returns the cached content if
+// the list is not modified.
+func fetchCached(c *Client, target string) (string, error) {
+	cached, entry, ok := loadCache(target)
+	if !ok {
+		entry = cacheEntry{}
+	}
+	res, err := fetch(c, target, entry)
+	if err != nil {
+		return "", err
+	}
+	entry.URL, entry.Fetched = target, time.Now()
+	if res.notModified {
+		saveCache(target, "", entry)
+		return cached, nil
+	}
+	entry.ETag, entry.LastModified = res.etag, res.lastModified
+	saveCache(target, res.body, entry)
+	return res.body, nil
+}
@@ -3,24 +3,26 @@ package main
 import (
 	"bufio"
 	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/sunshineplan/httpproxy"
 	"github.com/sunshineplan/httpproxy/auth"
-	"github.com/sunshineplan/limiter"
 	"github.com/sunshineplan/utils/httpsvr"
 	"golang.org/x/net/proxy"
 )
 
 type Client struct {
 	*Base
-	u     *url.URL
-	proxy proxy.Dialer
+	proxy     *Pool
+	outbounds map[DialerType]*Pool
 
 	autoproxy *Autoproxy
+	sniff     bool
 }
 
 func init() {
@@ -28,58 +30,132 @@ func init() {
 	proxy.RegisterDialerType("https", httpproxy.FromURL)
 }
 
-func NewClient(base *Base, u *url.URL) (*Client, error) {
-	d, err := proxy.FromURL(u, nil)
+// NewClient returns a client which forwards requests through the upstream
+// proxies, balanced with round-robin by default.
+func NewClient(base *Base, u ...*url.URL) (*Client, error) {
+	p, err := NewPool(u...)
 	if err != nil {
 		return nil, err
 	}
-	c := &Client{Base: base, u: u, proxy: d}
+	c := &Client{Base: base, proxy: p}
 	c.Base.Handler = c.Handler(false)
 	return c, nil
 }
 
 func (c *Client) SetProxyAuth(pa *proxy.Auth) *Client {
-	if pa != nil {
-		c.u.User = url.UserPassword(pa.User, pa.Password)
-	} else {
-		c.u.User = nil
+	for _, u := range c.proxy.upstreams {
+		u.setProxyAuth(pa)
 	}
-	if d, ok := c.proxy.(*httpproxy.Dialer); ok {
-		if pa != nil {
-			d.Auth = auth.Basic{Username: pa.User, Password: pa.Password}
-		} else {
-			d.Auth = nil
-		}
-	} else if c.u.Scheme == "socks5" || c.u.Scheme == "socks5h" {
-		addr := c.u.Hostname()
-		port := c.u.Port()
-		if port == "" {
-			port = "1080"
+	return c
+}
+
+func (c *Client) SetAuthorization(a auth.Authorization) *Client {
+	for _, u := range c.proxy.upstreams {
+		if d, ok := u.dialer.(*httpproxy.Dialer); ok {
+			d.Auth = a
 		}
-		c.proxy, _ = proxy.SOCKS5("tcp", net.JoinHostPort(addr, port), pa, nil)
 	}
 	return c
 }
 
+// SetTLSConfig sets the TLS configuration for HTTPS upstreams, the
+// default one if config is nil. If ServerName is empty, the host of each
+// upstream is used.
 func (c *Client) SetTLSConfig(config *tls.Config) *Client {
-	if d, ok := c.proxy.(*httpproxy.Dialer); ok {
-		d.TLSConfig = config
+	if config == nil {
+		config = &tls.Config{}
 	}
+	for _, u := range c.proxy.upstreams {
+		if d, ok := u.dialer.(*httpproxy.Dialer); ok && u.u.Scheme == "https" {
+			d.TLSConfig = config.Clone()
+			if d.TLSConfig.ServerName == "" {
+				d.TLSConfig.ServerName = u.u.Hostname()
+			}
+		}
+	}
+	return c
+}
+
+func (c *Client) SetStrategy(strategy Strategy) *Client {
+	c.proxy.strategy = strategy
+	return c
+}
+
+func (c *Client) SetHealthCheck(target string, interval time.Duration) *Client {
+	c.proxy.SetHealthCheck(target, interval)
 	return c
 }
 
-func (c *Client) SetAutoproxy(port string, autoproxy *proxy.PerHost) *Client {
-	if port != "" && autoproxy != nil {
+// SetSniff sets whether CONNECT requests to addresses on the autoproxy
+// listener are routed by the server name read from the tunnel.
+func (c *Client) SetSniff(sniff bool) *Client {
+	c.sniff = sniff
+	return c
+}
+
+// SetOutbound adds a named outbound for autoproxy rules, dialing through
+// the given proxies with the strategy and health check of the client.
+// Authentication is taken from the proxy URLs.
+func (c *Client) SetOutbound(name DialerType, u ...*url.URL) error {
+	if isBuiltinOutbound(name) {
+		return errors.New("reserved outbound name: " + string(name))
+	}
+	p, err := NewPool(u...)
+	if err != nil {
+		return err
+	}
+	p.strategy = c.proxy.strategy
+	p.SetHealthCheck(c.proxy.target, c.proxy.interval)
+	if c.outbounds == nil {
+		c.outbounds = make(map[DialerType]*Pool)
+	}
+	c.outbounds[name] = p
+	return nil
+}
+
+// SetAutoproxy serves a listener which dials destinations as the routes
+// decide and others directly. It also serves the routes as
+// /proxy.pac for clients which can make the choice by themselves.
+func (c *Client) SetAutoproxy(port string, routes []route) *Client {
+	if port != "" {
 		server := httpsvr.New()
 		server.Handler = c.Handler(true)
 		server.Host = c.Base.Host
 		server.Port = port
-		c.autoproxy = &Autoproxy{Server: server, PerHost: autoproxy}
+		c.autoproxy = &Autoproxy{Server: server, dialers: map[DialerType]proxy.Dialer{
+			UseDirect: &Dialer{UseDirect, direct{}},
+			UseProxy:  &Dialer{UseProxy, c.proxy},
+			UseReject: &Dialer{UseReject, reject{}},
+		}}
+		for name, p := range c.outbounds {
+			c.autoproxy.dialers[name] = &Dialer{name, p}
+		}
+		c.autoproxy.update(routes)
 	}
 	return c
 }
 
+// PAC serves the proxy auto-config file, which points to the proxy
+// listener on the host the file is requested from. Destinations of other
+// outbounds go to the autoproxy listener, which dials them as routed.
+func (c *Client) PAC(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	c.autoproxy.RLock()
+	defer c.autoproxy.RUnlock()
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	writePAC(w, net.JoinHostPort(host, c.Port), net.JoinHostPort(host, c.autoproxy.Port), c.autoproxy.routes)
+}
+
 func (c *Client) Run() error {
+	c.proxy.Start()
+	defer c.proxy.Stop()
+	for _, p := range c.outbounds {
+		p.Start()
+		defer p.Stop()
+	}
 	if c.autoproxy != nil {
 		go func() {
 			if err := c.autoproxy.Run(); err != nil {
@@ -90,26 +166,39 @@ func (c *Client) Run() error {
 	return c.Base.Run()
 }
 
-func (c *Client) HTTP(user user, lim *limiter.Limiter, w http.ResponseWriter, r *http.Request, autoproxy bool) {
+// dial connects to address through the proxy, or as the autoproxy rules
+// decide if autoproxy is true.
+func (c *Client) dial(address string, autoproxy bool) (net.Conn, error) {
+	return c.dialHost(address, "", autoproxy)
+}
+
+// dialHost dials address as the autoproxy rules decide for host, or for
+// the host of address if host is empty.
+func (c *Client) dialHost(address, host string, autoproxy bool) (net.Conn, error) {
+	if autoproxy {
+		c.autoproxy.RLock()
+		defer c.autoproxy.RUnlock()
+		return c.autoproxy.dialHost("tcp", address, host)
+	}
+	return c.proxy.Dial("tcp", address)
+}
+
+func (c *Client) HTTP(user user, lim *flow, w http.ResponseWriter, r *http.Request, autoproxy bool) {
 	port := r.URL.Port()
 	if port == "" {
 		port = "80"
 	}
-	var conn net.Conn
-	var err error
-	if autoproxy {
-		c.autoproxy.RLock()
-		conn, err = c.autoproxy.Dial("tcp", net.JoinHostPort(r.URL.Hostname(), port))
-		c.autoproxy.RUnlock()
-	} else {
-		conn, err = c.proxy.Dial("tcp", net.JoinHostPort(r.URL.Hostname(), port))
-	}
+	start := time.Now()
+	conn, err := c.dial(net.JoinHostPort(r.URL.Hostname(), port), autoproxy)
 	var name string
 	if user.name != "" {
 		name = "[" + user.name + "]"
 	}
 	var direct bool
-	if t, ok := IsTyped(conn, err); ok {
+	t, ok := IsTyped(conn, err)
+	observeDial(t, start)
+	setDialer(w, t)
+	if ok {
 		accessLogger.Printf("[%s]%s%s %s %s", t, r.RemoteAddr, name, r.Method, r.URL)
 		if t == UseDirect {
 			direct = true
@@ -117,11 +206,17 @@ func (c *Client) HTTP(user user, lim *limiter.Limiter, w http.ResponseWriter, r
 	} else {
 		accessLogger.Printf("[C]%s%s %s %s", r.RemoteAddr, name, r.Method, r.URL)
 	}
-	if err != nil {
+	if t == UseReject {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
 
+	if !direct {
+		uploadBody(user, r)
+	}
 	if err := r.Write(conn); err != nil {
 		conn.Close()
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
@@ -150,22 +245,22 @@ func (c *Client) HTTP(user user, lim *limiter.Limiter, w http.ResponseWriter, r
 	}
 }
 
-func (c *Client) HTTPS(u user, lim *limiter.Limiter, w http.ResponseWriter, r *http.Request, autoproxy bool) {
-	var dest_conn net.Conn
-	var err error
-	if autoproxy {
-		c.autoproxy.RLock()
-		dest_conn, err = c.autoproxy.Dial("tcp", r.Host)
-		c.autoproxy.RUnlock()
-	} else {
-		dest_conn, err = c.proxy.Dial("tcp", r.Host)
+func (c *Client) HTTPS(u user, lim *flow, w http.ResponseWriter, r *http.Request, autoproxy bool) {
+	if autoproxy && c.sniff && net.ParseIP(r.URL.Hostname()) != nil && sniffPort(r.URL.Port()) {
+		c.httpsSniffed(u, lim, w, r)
+		return
 	}
+	start := time.Now()
+	dest_conn, err := c.dial(r.Host, autoproxy)
 	var name string
 	if u.name != "" {
 		name = "[" + u.name + "]"
 	}
 	var direct bool
-	if t, ok := IsTyped(dest_conn, err); ok {
+	t, ok := IsTyped(dest_conn, err)
+	observeDial(t, start)
+	setDialer(w, t)
+	if ok {
 		accessLogger.Printf("[%s]%s%s %s %s", t, r.RemoteAddr, name, r.Method, r.URL)
 		if t == UseDirect {
 			direct = true
@@ -173,11 +268,39 @@ func (c *Client) HTTPS(u user, lim *limiter.Limiter, w http.ResponseWriter, r *h
 	} else {
 		accessLogger.Printf("[C]%s%s %s %s", r.RemoteAddr, name, r.Method, r.URL)
 	}
+	if t == UseReject {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	client_conn, _, err := hijacker.Hijack()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
 
+	if direct {
+		pipe(client_conn, dest_conn, user{}, nil)
+	} else {
+		pipe(client_conn, dest_conn, u, lim)
+	}
+}
+
+// httpsSniffed establishes the tunnel of a CONNECT request to an address
+// before dialing it, and routes it by the autoproxy rules for the server
+// name the client sends first.
+func (c *Client) httpsSniffed(u user, lim *flow, w http.ResponseWriter, r *http.Request) {
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
@@ -191,21 +314,66 @@ func (c *Client) HTTPS(u user, lim *limiter.Limiter, w http.ResponseWriter, r *h
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
+	host, client_conn := sniffHost(client_conn)
+
+	start := time.Now()
+	dest_conn, err := c.dialHost(r.Host, host, true)
+	var name string
+	if u.name != "" {
+		name = "[" + u.name + "]"
+	}
+	if host != "" {
+		host = " (" + host + ")"
+	}
+	var direct bool
+	t, ok := IsTyped(dest_conn, err)
+	observeDial(t, start)
+	setDialer(w, t)
+	if ok {
+		accessLogger.Printf("[%s]%s%s %s %s%s", t, r.RemoteAddr, name, r.Method, r.URL, host)
+		if t == UseDirect {
+			direct = true
+		}
+	} else {
+		accessLogger.Printf("[C]%s%s %s %s%s", r.RemoteAddr, name, r.Method, r.URL, host)
+	}
+	if err != nil {
+		// the tunnel is established, so the client only sees it closed
+		if t != UseReject {
+			errorLogger.Println(err)
+		}
+		client_conn.Close()
+		return
+	}
 
-	go transfer(dest_conn, client_conn, user{}, nil)
 	if direct {
-		go transfer(client_conn, dest_conn, user{}, nil)
+		pipe(client_conn, dest_conn, user{}, nil)
 	} else {
-		go transfer(client_conn, dest_conn, u, lim)
+		pipe(client_conn, dest_conn, u, lim)
 	}
 }
 
 func (c *Client) Handler(autoproxy bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		user, lim, ok := c.Auth(w, r)
+		if autoproxy && isPAC(r) {
+			c.PAC(w, r)
+			return
+		}
+		w, done := withLog(w, r)
+		defer done()
+		user, speed, ok := c.Auth(w, r)
 		if !ok {
 			return
 		}
+		defer leave(user)
+		listener := "main"
+		if autoproxy {
+			listener = "autoproxy"
+		}
+		lim := shape(listener, user, r.RemoteAddr, speed)
+		defer lim.leave()
+		setUser(w, user)
+		metrics.requests.with(requestKind(r)).Add(1)
 		if r.Method == http.MethodConnect {
 			c.HTTPS(user, lim, w, r, autoproxy)
 		} else {
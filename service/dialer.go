@@ -7,20 +7,18 @@ import (
 	"golang.org/x/net/proxy"
 )
 
-type DialerType int
+// DialerType tells how a destination is dialed. Besides the built-in
+// types, named outbounds of autoproxy use their names as the type.
+type DialerType string
 
 const (
-	UseDirect DialerType = iota + 1
-	UseProxy
+	UseDirect DialerType = "direct"
+	UseProxy  DialerType = "proxy"
+	UseReject DialerType = "reject"
 )
 
-var typeList = map[DialerType]string{
-	UseDirect: "direct",
-	UseProxy:  "proxy",
-}
-
 func (t DialerType) String() string {
-	return typeList[t]
+	return string(t)
 }
 
 type Dialer struct {
@@ -92,12 +90,12 @@ func IsTyped(conn net.Conn, err error) (DialerType, bool) {
 		if v, ok := conn.(Typed); ok {
 			return v.Type(), true
 		}
-		return 0, false
+		return "", false
 	}
 	if err != nil {
-		if v, ok := conn.(Typed); ok {
-			return v.Type(), true
+		if v, ok := err.(Error); ok {
+			return v.DialerType, true
 		}
 	}
-	return 0, false
+	return "", false
 }
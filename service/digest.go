@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sunshineplan/httpproxy/auth"
+)
+
+const realm = "HTTP(S) Proxy Server"
+
+const nonceLifetime = 5 * time.Minute
+
+var nonceKey = make([]byte, 32)
+
+// nonceCounts holds the issue time and the last nonce count of the nonces
+// in use, so that a request can not be replayed with the same count.
+var nonceCounts = struct {
+	sync.Mutex
+	m map[string]nonceCount
+}{m: make(map[string]nonceCount)}
+
+type nonceCount struct {
+	issued time.Time
+	nc     uint64
+}
+
+func init() {
+	rand.Read(nonceKey)
+}
+
+func nonceMAC(b []byte) []byte {
+	mac := hmac.New(sha256.New, nonceKey)
+	mac.Write(b)
+	return mac.Sum(nil)[:16]
+}
+
+// newNonce returns a stateless nonce made of its issue time, random bytes
+// which tell apart the nonces issued at once, and a MAC.
+func newNonce() string {
+	b := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Unix()))
+	b = append(b, make([]byte, 8)...)
+	rand.Read(b[8:])
+	return base64.RawURLEncoding.EncodeToString(append(b, nonceMAC(b)...))
+}
+
+func checkNonce(nonce string) (issued time.Time, valid, stale bool) {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 32 || !hmac.Equal(b[16:], nonceMAC(b[:16])) {
+		return
+	}
+	issued = time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+	return issued, true, time.Since(issued) > nonceLifetime
+}
+
+// useNonce reports whether nc is greater than every count used with the
+// nonce before, and records it. Expired nonces are forgotten as new ones
+// come into use.
+func useNonce(nonce string, issued time.Time, nc uint64) bool {
+	nonceCounts.Lock()
+	defer nonceCounts.Unlock()
+	c, ok := nonceCounts.m[nonce]
+	if !ok {
+		for k, v := range nonceCounts.m {
+			if time.Since(v.issued) > nonceLifetime {
+				delete(nonceCounts.m, k)
+			}
+		}
+	} else if nc <= c.nc {
+		return false
+	}
+	nonceCounts.m[nonce] = nonceCount{issued, nc}
+	return true
+}
+
+func (base *Base) challenge(w http.ResponseWriter, stale bool) {
+	header := w.Header()
+	if base.digest {
+		nonce := newNonce()
+		for _, algorithm := range []string{"SHA-256", "MD5"} {
+			header.Add("Proxy-Authenticate", auth.NewDigestChallenge(realm, nonce, algorithm, stale).String())
+		}
+	}
+	header.Add("Proxy-Authenticate", `Basic realm="`+realm+`"`)
+}
+
+// credentials extracts the account from the Basic or, if enabled, Digest
+// credentials of r. For Digest, stale reports an expired nonce or a nonce
+// count not greater than the last one, which asks the client to start
+// over with a new nonce. Digest only works for accounts whose password is
+// stored in plaintext.
+func (base *Base) credentials(r *http.Request) (account auth.Basic, ok, stale bool) {
+	if account, ok = auth.ParseBasic(r); ok || !base.digest {
+		return
+	}
+	c, ok := auth.ParseDigest(r)
+	if !ok {
+		return
+	}
+	issued, valid, expired := checkNonce(c.Nonce())
+	if !valid || c.NC() == 0 {
+		return auth.Basic{}, true, false
+	} else if expired {
+		return auth.Basic{}, false, true
+	}
+	if a, _, found := base.lookup(c.Username()); found && !isHashed(a.Password) && c.Verify(r.Method, a.Password) {
+		if !useNonce(c.Nonce(), issued, c.NC()) {
+			return auth.Basic{}, false, true
+		}
+		account = a
+	}
+	return account, true, false
+}
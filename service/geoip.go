@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+const resolveTimeout = 5 * time.Second
+
+// resolveIP resolves hosts for rules on destination addresses and routes
+// resolving names locally.
+var resolveIP = func(host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	if dnsResolver != nil {
+		return dnsResolver.LookupIP(ctx, host)
+	}
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+// ipMatcher matches destination addresses by something other than a list
+// of networks, such as the country in a GeoIP database.
+type ipMatcher interface {
+	matchIP(ip net.IP) bool
+}
+
+// mmdbCountries matches addresses located in countries by a MaxMind DB.
+type mmdbCountries struct {
+	db        *maxminddb.Reader
+	countries map[string]bool
+}
+
+func (m mmdbCountries) matchIP(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	var code string
+	if err := m.db.Lookup(addr.Unmap()).DecodePath(&code, "country", "iso_code"); err != nil {
+		return false
+	}
+	return m.countries[code]
+}
+
+var mmdbMarker = "\xab\xcd\xefMaxMind.com"
+
+// addGeoIP adds the networks of countries from a GeoIP database, which is
+// either a MaxMind DB such as GeoLite2-Country or a v2fly geoip.dat.
+func addGeoIP(r *rules, data string, countries []string) error {
+	set := make(map[string]bool)
+	for _, i := range countries {
+		set[strings.ToUpper(i)] = true
+	}
+	if len(set) == 0 {
+		return errors.New("no country")
+	}
+	if strings.Contains(data, mmdbMarker) {
+		db, err := maxminddb.OpenBytes([]byte(data))
+		if err != nil {
+			return err
+		}
+		r.matchers = append(r.matchers, mmdbCountries{db, set})
+		return nil
+	}
+	return readGeoIPDat([]byte(data), func(code string, network *net.IPNet) {
+		if set[strings.ToUpper(code)] {
+			r.networks = append(r.networks, network)
+		}
+	})
+}
+
+// readGeoIPDat reads the GeoIPList protobuf message of v2fly geoip.dat:
+//
+//	message CIDR { bytes ip = 1; uint32 prefix = 2; }
+//	message GeoIP { string country_code = 1; repeated CIDR cidr = 2; }
+//	message GeoIPList { repeated GeoIP entry = 1; }
+func readGeoIPDat(b []byte, fn func(string, *net.IPNet)) error {
+	return readProto(b, func(num int, v []byte) error {
+		if num != 1 {
+			return nil
+		}
+		var code string
+		var cidrs [][]byte
+		if err := readProto(v, func(num int, v []byte) error {
+			switch num {
+			case 1:
+				code = string(v)
+			case 2:
+				cidrs = append(cidrs, v)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, cidr := range cidrs {
+			var ip net.IP
+			var prefix int
+			if err := readProto(cidr, func(num int, v []byte) error {
+				switch num {
+				case 1:
+					ip = net.IP(v)
+				case 2:
+					n, _ := binary.Uvarint(v)
+					prefix = int(n)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			if len(ip) != net.IPv4len && len(ip) != net.IPv6len || prefix > len(ip)*8 {
+				return errors.New("bad geoip.dat cidr")
+			}
+			fn(code, &net.IPNet{IP: ip, Mask: net.CIDRMask(prefix, len(ip)*8)})
+		}
+		return nil
+	})
+}
+
+// readProto calls fn with the number and value of every field of a
+// protobuf message. Varint values are passed in their encoded form.
+func readProto(b []byte, fn func(int, []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("bad protobuf key")
+		}
+		b = b[n:]
+		var v []byte
+		switch key & 7 {
+		case 0: // varint
+			_, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errors.New("bad protobuf varint")
+			}
+			v, b = b[:n], b[n:]
+		case 1: // 64-bit
+			if len(b) < 8 {
+				return errors.New("bad protobuf fixed64")
+			}
+			v, b = b[:8], b[8:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errors.New("bad protobuf length")
+			}
+			v, b = b[n:n+int(l)], b[n+int(l):]
+		case 5: // 32-bit
+			if len(b) < 4 {
+				return errors.New("bad protobuf fixed32")
+			}
+			v, b = b[:4], b[4:]
+		default:
+			return errors.New("unsupported protobuf wire type")
+		}
+		if err := fn(int(key>>3), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
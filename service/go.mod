@@ -4,11 +4,14 @@ go 1.26
 
 require (
 	github.com/fsnotify/fsnotify v1.10.1
+	github.com/oschwald/maxminddb-golang/v2 v2.1.1
 	github.com/sunshineplan/httpproxy v0.0.0-00010101000000-000000000000
 	github.com/sunshineplan/limiter v1.0.0
 	github.com/sunshineplan/service v1.0.26
 	github.com/sunshineplan/utils v0.1.85
+	golang.org/x/crypto v0.55.0
 	golang.org/x/net v0.58.0
+	golang.org/x/sys v0.47.0
 	golang.org/x/time v0.15.0
 )
 
@@ -16,7 +19,7 @@ require (
 	github.com/clipperhouse/uax29/v2 v2.2.0 // indirect
 	github.com/mattn/go-runewidth v0.0.19 // indirect
 	github.com/sunshineplan/progressbar v1.0.1 // indirect
-	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.41.0 // indirect
 )
 
 replace github.com/sunshineplan/httpproxy => ../
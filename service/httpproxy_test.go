@@ -2,15 +2,22 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
 	"maps"
 	"math/big"
@@ -19,14 +26,22 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/sunshineplan/httpproxy"
 	"github.com/sunshineplan/httpproxy/auth"
 	"github.com/sunshineplan/limiter"
+	"github.com/sunshineplan/utils/unit"
+	"golang.org/x/net/dns/dnsmessage"
 	"golang.org/x/net/proxy"
 )
 
@@ -65,6 +80,7 @@ func do(proxy proxy.Dialer, url string, req *http.Request) (resp *http.Response,
 	if err != nil {
 		return
 	}
+	defer c.Close()
 	if err = req.WriteProxy(c); err != nil {
 		return
 	}
@@ -199,6 +215,10 @@ func TestTLS(t *testing.T) {
 	defer s.Shutdown(context.Background())
 
 	c, _ := NewClient(NewBase("", getPort(t)), parseProxy("https://localhost:"+s.Port))
+	c.SetTLSConfig(nil)
+	if d := c.proxy.upstreams[0].dialer.(*httpproxy.Dialer); d.TLSConfig.ServerName != "localhost" {
+		t.Errorf("expect server name localhost; got %q", d.TLSConfig.ServerName)
+	}
 	c.SetTLSConfig(&tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
 	go c.Run()
 	defer c.Shutdown(context.Background())
@@ -222,7 +242,7 @@ func TestAuth(t *testing.T) {
 	req := newRequest(ts.URL, m)
 
 	s := NewServer(NewBase("", getPort(t)))
-	s.accounts.Store(serverUser, &limit{0, 0, limiter.New(limiter.Inf), nil})
+	s.accounts.Store(serverUser, &limit{speed: limiter.New(limiter.Inf)})
 	go s.Run()
 	defer s.Shutdown(context.Background())
 
@@ -251,7 +271,7 @@ func TestAuth(t *testing.T) {
 			func() *Client {
 				c, _ := NewClient(NewBase("", getPort(t)), parseProxy("http://localhost:"+s.Port))
 				c.SetProxyAuth(&proxy.Auth{User: serverUser.Username, Password: serverUser.Password})
-				c.accounts.Store(clientUser, &limit{0, 0, limiter.New(limiter.Inf), nil})
+				c.accounts.Store(clientUser, &limit{speed: limiter.New(limiter.Inf)})
 				return c
 			},
 			nil,
@@ -261,7 +281,7 @@ func TestAuth(t *testing.T) {
 			func() *Client {
 				c, _ := NewClient(NewBase("", getPort(t)), parseProxy("http://localhost:"+s.Port))
 				c.SetProxyAuth(&proxy.Auth{User: serverUser.Username, Password: serverUser.Password})
-				c.accounts.Store(clientUser, &limit{0, 0, limiter.New(limiter.Inf), nil})
+				c.accounts.Store(clientUser, &limit{speed: limiter.New(limiter.Inf)})
 				return c
 			},
 			auth.Basic{Username: clientUser.Username, Password: clientUser.Password},
@@ -299,3 +319,1927 @@ func TestAuth(t *testing.T) {
 		}
 	}
 }
+
+func TestHTTP2(t *testing.T) {
+	ts := httptest.NewServer(testHandler)
+	defer ts.Close()
+
+	cert, privkey, err := createCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.Remove(cert)
+		os.Remove(privkey)
+	}()
+
+	s := NewServer(NewBase("", getPort(t))).SetTLS(cert, privkey)
+	go s.Run()
+	defer s.Shutdown(context.Background())
+	time.Sleep(time.Second)
+
+	d, _ := httpproxy.NewDialer("localhost:"+s.Port, &tls.Config{InsecureSkipVerify: true}, nil, nil)
+	m := map[string]string{"Hello": "world"}
+	var addr string
+	for i := range 3 {
+		c, err := d.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if i == 0 {
+			addr = c.LocalAddr().String()
+		} else if a := c.LocalAddr().String(); a != addr {
+			t.Errorf("#%d expect shared connection %s; got %s", i, addr, a)
+		}
+		c.Close()
+
+		resp, res, err := do(d, ts.URL, newRequest(ts.URL, m))
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if !maps.Equal(m, res) {
+			t.Errorf("#%d expect %v; got %v", i, m, res)
+		}
+		if v := resp.Header.Get("Hello"); v != "world" {
+			t.Errorf("#%d expect world; got %s", i, v)
+		}
+	}
+
+	c, err := d.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expect deadline exceeded; got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.(proxy.ContextDialer).DialContext(ctx, "tcp", strings.TrimPrefix(ts.URL, "http://")); !errors.Is(err, context.Canceled) {
+		t.Errorf("expect canceled dial; got %v", err)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(b[:n], addr)
+		}
+	}()
+
+	cert, privkey, err := createCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.Remove(cert)
+		os.Remove(privkey)
+	}()
+
+	s1 := NewServer(NewBase("", getPort(t)))
+	go s1.Run()
+	defer s1.Shutdown(context.Background())
+	s2 := NewServer(NewBase("", getPort(t))).SetTLS(cert, privkey)
+	go s2.Run()
+	defer s2.Shutdown(context.Background())
+	time.Sleep(time.Second)
+
+	d1, _ := httpproxy.NewDialer("localhost:"+s1.Port, nil, nil, nil)
+	d2, _ := httpproxy.NewDialer("localhost:"+s2.Port, &tls.Config{InsecureSkipVerify: true}, nil, nil)
+	for i, d := range []proxy.Dialer{d1, d2} {
+		c, err := d.Dial("udp", echo.LocalAddr().String())
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		pc, ok := c.(net.PacketConn)
+		if !ok {
+			t.Fatalf("#%d expect net.PacketConn; got %T", i, c)
+		}
+		b := make([]byte, 1500)
+		for _, msg := range []string{"hello", "world", strings.Repeat("x", 1200)} {
+			if _, err := pc.WriteTo([]byte(msg), c.RemoteAddr()); err != nil {
+				t.Fatal(i, err)
+			}
+			n, _, err := pc.ReadFrom(b)
+			if err != nil {
+				t.Fatal(i, err)
+			}
+			if s := string(b[:n]); s != msg {
+				t.Errorf("#%d expect %q; got %q", i, msg, s)
+			}
+		}
+		c.Close()
+	}
+}
+
+func TestDigest(t *testing.T) {
+	ts := httptest.NewServer(testHandler)
+	defer ts.Close()
+	serverUser := auth.Basic{Username: "server", Password: "server_password"}
+	m := map[string]string{"Hello": "world"}
+	req := newRequest(ts.URL, m)
+
+	s := NewServer(NewBase("", getPort(t)).SetDigest(true))
+	s.accounts.Store(serverUser, &limit{speed: limiter.New(limiter.Inf)})
+	go s.Run()
+	defer s.Shutdown(context.Background())
+
+	c, _ := NewClient(NewBase("", getPort(t)), parseProxy("http://localhost:"+s.Port))
+	c.SetAuthorization(&auth.Digest{Username: serverUser.Username, Password: serverUser.Password})
+	go c.Run()
+	defer c.Shutdown(context.Background())
+	time.Sleep(time.Second)
+
+	for i, testcase := range []struct {
+		port      string
+		proxyAuth auth.Authorization
+		err       string
+	}{
+		{s.Port, &auth.Digest{Username: serverUser.Username, Password: serverUser.Password}, ""},
+		{s.Port, &auth.Digest{Username: serverUser.Username, Password: "wrong"}, "407 Proxy Authentication Required"},
+		{s.Port, auth.Bearer{Token: serverUser.Password}, "407 Proxy Authentication Required"},
+		{s.Port, serverUser, ""},
+		{c.Port, nil, ""},
+	} {
+		d, _ := httpproxy.NewDialer(":"+testcase.port, nil, nil, nil)
+		d.(*httpproxy.Dialer).Auth = testcase.proxyAuth
+		for range 2 {
+			_, res, err := do(d, ts.URL, req)
+			if testcase.err != "" {
+				if err == nil || !strings.Contains(err.Error(), testcase.err) {
+					t.Errorf("#%d expect %s, got %v", i, testcase.err, err)
+				}
+			} else if err != nil {
+				t.Error(i, err)
+			} else if !maps.Equal(m, res) {
+				t.Errorf("#%d expect %v; got %v", i, m, res)
+			}
+		}
+	}
+
+	connect := func(authorization string) *http.Response {
+		conn, err := net.Dial("tcp", "localhost:"+s.Port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		req, _ := http.NewRequest(http.MethodConnect, ts.URL, nil)
+		req.Host = strings.TrimPrefix(ts.URL, "http://")
+		req.URL = &url.URL{Opaque: req.Host}
+		if authorization != "" {
+			req.Header.Set("Proxy-Authorization", authorization)
+		}
+		req.Write(conn)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	digest := &auth.Digest{Username: serverUser.Username, Password: serverUser.Password}
+	digest.Challenge(auth.ParseChallenges(connect("")))
+	req, _ = http.NewRequest(http.MethodConnect, ts.URL, nil)
+	req.URL = &url.URL{Opaque: strings.TrimPrefix(ts.URL, "http://")}
+	digest.Authorization(req)
+	authorization := req.Header.Get("Proxy-Authorization")
+	if resp := connect(authorization); resp.StatusCode != http.StatusOK {
+		t.Errorf("expect 200; got %s", resp.Status)
+	}
+	if resp := connect(authorization); resp.StatusCode != http.StatusProxyAuthRequired ||
+		!strings.Contains(resp.Header.Get("Proxy-Authenticate"), "stale=true") {
+		t.Errorf("expect replayed credentials refused as stale; got %s %v", resp.Status, resp.Header)
+	}
+}
+
+func TestHashedSecrets(t *testing.T) {
+	var rows []string
+	for _, algorithm := range []string{"", "bcrypt", "argon2id", "sha256-crypt", "sha512-crypt"} {
+		secret := "password"
+		if algorithm != "" {
+			var err error
+			if secret, err = hashPassword(algorithm, "password"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		rows = append(rows, "user"+algorithm+":"+secret+" 1G|1M")
+	}
+	rows = append(rows, "legacy:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1")
+	rows = append(rows, "rounds:$5$rounds=5000$toolongsaltstrin$Un/5jzAHMgOGZ5.mWJpuVolil07guHPvOW8mGRcvxa5")
+
+	base := NewBase("", "")
+	parseSecrets(base.accounts, rows)
+	for _, testcase := range []struct {
+		username, password string
+		found              bool
+	}{
+		{"user", "password", true},
+		{"user", "wrong", false},
+		{"userbcrypt", "password", true},
+		{"userbcrypt", "wrong", false},
+		{"userargon2id", "password", true},
+		{"userargon2id", "wrong", false},
+		{"usersha256-crypt", "password", true},
+		{"usersha512-crypt", "password", true},
+		{"usersha512-crypt", "wrong", false},
+		{"legacy", "Hello world!", true},
+		{"rounds", "This is just a test", true},
+		{"unknown", "password", false},
+	} {
+		for range 2 {
+			if found, _, _ := base.checkAccount(auth.Basic{Username: testcase.username, Password: testcase.password}); found != testcase.found {
+				t.Errorf("%s:%s expect %v; got %v", testcase.username, testcase.password, testcase.found, found)
+			}
+		}
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	dir := t.TempDir()
+	secretsFile := filepath.Join(dir, "secrets")
+	whitelistFile := filepath.Join(dir, "whitelist")
+	if err := os.WriteFile(secretsFile, []byte("# comment\nuser1:password1 1G|1M\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	base := NewBase("", "")
+	parseSecrets(base.accounts, []string{"user1:password1 1G|1M"})
+	a := NewAdmin(base, "", "token", secretsFile, whitelistFile)
+	ts := httptest.NewServer(a.Handler)
+	defer ts.Close()
+
+	call := func(method, path, token, body string) int {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for i, testcase := range []struct {
+		method, path, token, body string
+		code                      int
+	}{
+		{"GET", "/accounts", "wrong", "", http.StatusUnauthorized},
+		{"GET", "/accounts", "token", "", http.StatusOK},
+		{"POST", "/accounts", "token", `{"username":"user1","password":"p"}`, http.StatusConflict},
+		{"POST", "/accounts", "token", `{"username":"user2","password":"password2","hash":"bcrypt","limit":"1G:10G"}`, http.StatusCreated},
+		{"PUT", "/accounts/user1", "token", `{"limit":"2G|2M"}`, http.StatusNoContent},
+		{"PUT", "/accounts/user3", "token", `{"limit":"2G"}`, http.StatusNotFound},
+		{"POST", "/accounts", "token", `{"username":"user3","password":"password3","limit":"bad"}`, http.StatusBadRequest},
+		{"POST", "/accounts", "token", `{"username":"user3","password":"password3"}`, http.StatusCreated},
+		{"DELETE", "/accounts/user3", "token", "", http.StatusNoContent},
+		{"POST", "/accounts", "token", `{"username":"user4\nroot","password":"pw"}`, http.StatusBadRequest},
+		{"POST", "/accounts", "token", `{"username":"user4","password":"x\nroot:pw"}`, http.StatusBadRequest},
+		{"POST", "/accounts", "token", `{"username":"user4","password":"a b"}`, http.StatusBadRequest},
+		{"POST", "/accounts", "token", `{"username":"user4","password":"a#b"}`, http.StatusBadRequest},
+		{"POST", "/accounts", "token", `{"username":"user4","password":"pw","limit":"1G\nroot:pw"}`, http.StatusBadRequest},
+		{"PUT", "/accounts/user1", "token", `{"password":"x\rroot:pw"}`, http.StatusBadRequest},
+		{"POST", "/whitelist", "token", `{"address":"10.0.0.0/8","limit":"1G"}`, http.StatusCreated},
+		{"PUT", "/whitelist/10.0.0.0/8", "token", `{"limit":"2G"}`, http.StatusNoContent},
+		{"POST", "/whitelist", "token", `{"address":"bad"}`, http.StatusBadRequest},
+		{"POST", "/usage/reset", "token", "", http.StatusNoContent},
+		{"POST", "/usage/reset", "token", `{"user":"unknown"}`, http.StatusNotFound},
+		{"GET", "/usage/history?user=unknown", "token", "", http.StatusNotFound},
+	} {
+		if code := call(testcase.method, testcase.path, testcase.token, testcase.body); code != testcase.code {
+			t.Errorf("#%d %s %s expect %d; got %d", i, testcase.method, testcase.path, testcase.code, code)
+		}
+	}
+
+	if found, _, _ := base.checkAccount(auth.Basic{Username: "user2", Password: "password2"}); !found {
+		t.Error("expect user2 found")
+	}
+	if _, _, found := base.lookup("user3"); found {
+		t.Error("expect user3 removed")
+	}
+	if _, _, found := base.lookup("root"); found {
+		t.Error("expect no account injected")
+	}
+	b, _ := os.ReadFile(secretsFile)
+	if expect := "# comment\nuser1:password1 2G|2M\nuser2:$2a$"; !strings.HasPrefix(string(b), expect) {
+		t.Errorf("expect prefix %q; got %q", expect, b)
+	}
+	b, _ = os.ReadFile(whitelistFile)
+	if expect := "10.0.0.0/8 2G\n"; string(b) != expect {
+		t.Errorf("expect %q; got %q", expect, b)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ts := httptest.NewServer(testHandler)
+	defer ts.Close()
+	account := auth.Basic{Username: "metrics", Password: "password"}
+	authFailed := metrics.authFailed.Get()
+
+	s := NewServer(NewBase("", getPort(t)))
+	s.accounts.Store(account, &limit{speed: limiter.New(limiter.Inf)})
+	go s.Run()
+	defer s.Shutdown(context.Background())
+	time.Sleep(time.Second)
+
+	req := newRequest(ts.URL, map[string]string{"Hello": "world"})
+	d, _ := httpproxy.NewDialer(":"+s.Port, nil, &proxy.Auth{User: "metrics", Password: "wrong"}, nil)
+	if _, _, err := do(d, ts.URL, req); err == nil {
+		t.Fatal("expect error; got nil")
+	}
+	d, _ = httpproxy.NewDialer(":"+s.Port, nil, &proxy.Auth{User: account.Username, Password: account.Password}, nil)
+	if _, _, err := do(d, ts.URL, req); err != nil {
+		t.Fatal(err)
+	}
+	if n := metrics.authFailed.Get(); n != authFailed+1 {
+		t.Errorf("expect %d auth failures; got %d", authFailed+1, n)
+	}
+
+	m := httptest.NewServer(NewMetrics(s.Base, "").Handler)
+	defer m.Close()
+	resp, err := http.Get(m.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	for _, expect := range []string{
+		"# TYPE httpproxy_requests_total counter\n",
+		"httpproxy_requests_total{kind=\"connect\"} ",
+		"httpproxy_active_tunnels{protocol=\"tcp\"} ",
+		"httpproxy_auth_failures_total ",
+		"httpproxy_dial_duration_seconds_bucket{dialer=\"direct\",le=\"+Inf\"} ",
+		"httpproxy_dial_duration_seconds_count{dialer=\"direct\"} ",
+		"httpproxy_traffic_bytes{user=\"metrics\",type=\"account\",direction=\"download\",period=\"total\"} ",
+	} {
+		if !strings.Contains(string(b), expect) {
+			t.Errorf("expect %q in metrics; got\n%s", expect, b)
+		}
+	}
+}
+
+func TestJSONLog(t *testing.T) {
+	ts := httptest.NewServer(testHandler)
+	defer ts.Close()
+	file := filepath.Join(t.TempDir(), "access.json")
+	initJSONLogger(file)
+	defer func() { jsonLogger = nil }()
+
+	s := NewServer(NewBase("", getPort(t)))
+	s.accounts.Store(auth.Basic{Username: "json", Password: "password"}, &limit{speed: limiter.New(limiter.Inf)})
+	go s.Run()
+	defer s.Shutdown(context.Background())
+	time.Sleep(time.Second)
+
+	req := newRequest(ts.URL, map[string]string{"Hello": "world"})
+	d, _ := httpproxy.NewDialer(":"+s.Port, nil, nil, nil)
+	if _, _, err := do(d, ts.URL, req); err == nil {
+		t.Fatal("expect error; got nil")
+	}
+	d, _ = httpproxy.NewDialer(":"+s.Port, nil, &proxy.Auth{User: "json", Password: "password"}, nil)
+	if _, _, err := do(d, ts.URL, req); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type entry struct {
+		User     string
+		Method   string
+		Target   string
+		Dialer   string
+		Status   int
+		BytesIn  int64 `json:"bytes_in"`
+		BytesOut int64 `json:"bytes_out"`
+		Duration int64
+	}
+	var entries []entry
+	for line := range strings.Lines(string(b)) {
+		var e entry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expect 2 entries; got %d: %s", len(entries), b)
+	}
+	if e := entries[0]; e.Status != http.StatusProxyAuthRequired || e.User != "" || e.Method != http.MethodConnect {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+	target := strings.TrimPrefix(ts.URL, "http://")
+	if e := entries[1]; e.Status != http.StatusOK || e.User != "json" || e.Target != target || e.Dialer != "direct" ||
+		e.BytesIn == 0 || e.BytesOut == 0 || e.Duration == 0 {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+	account := auth.Basic{Username: "upload", Password: "password"}
+	l, err := parseLimit("1K:1G@upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := l.String(); s != "1KB:1GB@upload" {
+		t.Errorf("expect 1KB:1GB@upload; got %s", s)
+	}
+
+	s := NewServer(NewBase("", getPort(t)))
+	s.accounts.Store(account, l)
+	go s.Run()
+	defer s.Shutdown(context.Background())
+	time.Sleep(time.Second)
+
+	d, _ := httpproxy.NewDialer(":"+s.Port, nil, &proxy.Auth{User: account.Username, Password: account.Password}, nil)
+	req, _ := http.NewRequest("POST", ts.URL, strings.NewReader(strings.Repeat("a", 2048)))
+	if _, _, err := do(d, ts.URL, req); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	v, ok := recordMap.Load(user{account.Username, false})
+	if !ok {
+		t.Fatal("expect record found")
+	}
+	if n := v.upload.total.Get(); n <= 2048 {
+		t.Errorf("expect upload more than 2048; got %d", n)
+	}
+	if n := v.download.total.Get(); n == 0 {
+		t.Error("expect download; got 0")
+	}
+	if _, _, err := do(d, ts.URL, newRequest(ts.URL, nil)); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("expect 403 Forbidden; got %v", err)
+	}
+
+	r := new(record)
+	r.download.add([3]int64{2, 2, 2})
+	r.upload.add([3]int64{1, 1, 1})
+	for _, testcase := range []struct {
+		limit    string
+		exceeded bool
+	}{
+		{"3", false},
+		{"3@sum", true},
+		{"2:3@download", true},
+		{"2:3@upload", false},
+	} {
+		l, err := parseLimit(testcase.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exceeded := l.isExceeded(r); exceeded != testcase.exceeded {
+			t.Errorf("%s expect %v; got %v", testcase.limit, testcase.exceeded, exceeded)
+		}
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	now := time.Now()
+	parseRecord([]string{
+		now.Format(timeFormat),
+		"old:1:2:3",
+		"::1[w]:4:5:6",
+		"short",
+		"short:1",
+		"short[w]:",
+		"short:1:2:3:4:5:6",
+	})
+	for _, testcase := range []struct {
+		user             user
+		download, upload string
+	}{
+		{user{"old", false}, "1:2:3", "0:0:0"},
+		{user{"::1", true}, "4:5:6", "0:0:0"},
+	} {
+		v, ok := recordMap.Load(testcase.user)
+		if !ok {
+			t.Errorf("expect %v found", testcase.user)
+			continue
+		}
+		if s := fmt.Sprintf("%d:%d:%d", v.download.today.Get(), v.download.monthly.Get(), v.download.total.Get()); s != testcase.download {
+			t.Errorf("%v expect download %s; got %s", testcase.user, testcase.download, s)
+		}
+		if s := fmt.Sprintf("%d:%d:%d", v.upload.today.Get(), v.upload.monthly.Get(), v.upload.total.Get()); s != testcase.upload {
+			t.Errorf("%v expect upload %s; got %s", testcase.user, testcase.upload, s)
+		}
+		if day := (window{}).day(now); !v.day.Equal(day) {
+			t.Errorf("%v expect day %s; got %s", testcase.user, day, v.day)
+		}
+		recordMap.Delete(testcase.user)
+	}
+	if _, ok := recordMap.Load(user{"short", false}); ok {
+		t.Error("expect invalid records skipped")
+	}
+
+	u := user{"concurrent", false}
+	defer recordMap.Delete(u)
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() { count(u, io.Discard).Write(make([]byte, 10)) })
+	}
+	wg.Wait()
+	if v, _ := recordMap.Load(u); v.download.total.Get() != 100 {
+		t.Errorf("expect 100 bytes counted; got %d", v.download.total.Get())
+	}
+}
+
+func TestStore(t *testing.T) {
+	defer func(file string) { recordFile = file }(recordFile)
+	recordFile = filepath.Join(t.TempDir(), "database")
+	base := NewBase("", "")
+	parseSecrets(base.accounts, []string{"store:password 1G"})
+	u := user{"store", false}
+	defer recordMap.Delete(u)
+
+	// migrate a record file of the first version
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	fmt.Fprintf(zw, "%s\nstore:1:2:3\n", time.Now().Format(timeFormat))
+	zw.Close()
+	if err := os.WriteFile(recordFile, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := readRecords(recordFile); err != nil {
+		t.Fatal(err)
+	}
+	v, ok := recordMap.Load(u)
+	if !ok {
+		t.Fatal("expect record migrated")
+	}
+	v.mu.Lock()
+	v.download.history = []int64{7, 8}
+	v.upload.history = []int64{9}
+	v.warned = [3]int{0, 0, 80}
+	v.mu.Unlock()
+	expect := fmt.Sprint(v.stored(u))
+
+	for range 2 {
+		if err := saveRecord(base); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := os.ReadFile(recordFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte("httpproxy-usage 2 ")) || !bytes.Contains(b, []byte("\nsha256 ")) {
+		t.Errorf("expect versioned record file with checksum; got\n%s", b)
+	}
+	// the backup is the file of the first save, not the migrated one
+	if bak, err := os.ReadFile(recordFile + ".bak"); err != nil {
+		t.Error(err)
+	} else if _, records, err := decodeStore(bak); err != nil || len(records) != 1 {
+		t.Errorf("expect previous file kept as backup; got %d records, %v", len(records), err)
+	}
+	if _, err := os.Stat(recordFile + ".bak.tmp"); err == nil {
+		t.Error("expect no temporary backup left")
+	}
+	recordMap.Delete(u)
+	if err := readRecords(recordFile); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok = recordMap.Load(u); !ok || fmt.Sprint(v.stored(u)) != expect {
+		t.Errorf("expect %s; got %v", expect, v)
+	}
+	days := v.days()
+	if len(days) != 3 || days[1].Download != 7 || days[1].Upload != 9 || days[2].Download != 8 ||
+		days[1].Date != v.day.AddDate(0, 0, -1).Format(time.DateOnly) {
+		t.Errorf("expect 3 days of history; got %+v", days)
+	}
+
+	// a damaged file is not loaded, and the backup is
+	b[len(b)/2] ^= 1
+	if err := os.WriteFile(recordFile, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	recordMap.Delete(u)
+	if err := readRecords(recordFile); !errors.Is(err, errStoreChecksum) {
+		t.Errorf("expect checksum mismatch; got %v", err)
+	}
+	if _, ok := recordMap.Load(u); ok {
+		t.Error("expect nothing loaded from damaged file")
+	}
+	if err := readRecords(recordFile + ".bak"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok = recordMap.Load(u); !ok || fmt.Sprint(v.stored(u)) != expect {
+		t.Errorf("expect %s from backup; got %v", expect, v)
+	}
+	for _, s := range []string{"", "httpproxy-usage 2\n", "httpproxy-usage 3 2026-01-01T00:00:00Z 0\n"} {
+		b := []byte(s)
+		if s != "" {
+			b = fmt.Appendf(b, "sha256 %x\n", sha256.Sum256(b))
+		}
+		if _, _, err := decodeStore(b); err == nil {
+			t.Errorf("%q: expect error", s)
+		}
+	}
+}
+
+func TestWindow(t *testing.T) {
+	l, err := parseLimit("1G:20G|||weekly=5G, reset=31,rolling=30,tz=Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := l.String(); s != "1GB:20GB|||weekly=5GB,reset=31,rolling=30,tz=Asia/Tokyo" {
+		t.Errorf("expect 1GB:20GB|||weekly=5GB,reset=31,rolling=30,tz=Asia/Tokyo; got %s", s)
+	}
+	if l, _ := parseLimit("|||weekly=1G"); l.String() != "|||weekly=1GB" || !l.hasQuota() {
+		t.Errorf("expect weekly quota; got %s", l)
+	}
+	for _, s := range []string{"|||reset=0", "|||reset=32", "|||rolling=200", "|||tz=Nowhere/City", "|||monthly=1G"} {
+		if _, err := parseLimit(s); err == nil {
+			t.Errorf("%s expect error", s)
+		}
+	}
+
+	tokyo := l.window.loc
+	date := func(month time.Month, day, hour int) time.Time {
+		return time.Date(2026, month, day, hour, 0, 0, 0, tokyo)
+	}
+	for _, testcase := range []struct {
+		t, month time.Time
+	}{
+		{date(3, 10, 12), date(2, 28, 0)},
+		{date(2, 28, 0), date(2, 28, 0)},
+		{date(2, 27, 23), date(1, 31, 0)},
+		{date(1, 31, 0).Add(-time.Second), date(12, 31, 0).AddDate(-1, 0, 0)},
+	} {
+		if month := l.window.month(testcase.t); !month.Equal(testcase.month) {
+			t.Errorf("%s expect month from %s; got %s", testcase.t, testcase.month, month)
+		}
+	}
+
+	w := window{reset: 15, loc: tokyo}
+	r := new(record)
+	r.roll(w, date(1, 14, 23))
+	r.download.writer(io.Discard).Write(make([]byte, 100))
+	// Thursday of the same week, and the first day of a month
+	r.roll(w, date(1, 15, 1).In(time.UTC))
+	if today, weekly, monthly := quotaDownload.usage(r, w); today != 0 || weekly != 100 || monthly != 0 {
+		t.Errorf("expect 0, 100 and 0; got %d, %d and %d", today, weekly, monthly)
+	}
+	r.download.writer(io.Discard).Write(make([]byte, 30))
+	// Monday, four days after the 15th
+	r.roll(w, date(1, 19, 9))
+	r.download.writer(io.Discard).Write(make([]byte, 60))
+	if h := r.download.history; !slices.Equal(h, []int64{0, 0, 0, 30, 100}) {
+		t.Errorf("expect history [0 0 0 30 100]; got %v", h)
+	}
+	for _, testcase := range []struct {
+		limit    string
+		exceeded bool
+	}{
+		{"80|||reset=15,rolling=4,tz=Asia/Tokyo", false},
+		{"80|||reset=15,rolling=5,tz=Asia/Tokyo", true},
+		{"150|||reset=15,rolling=5,tz=Asia/Tokyo", false},
+		{"150|||reset=15,rolling=6,tz=Asia/Tokyo", true},
+		{"100|||reset=15,tz=Asia/Tokyo", false},
+		{"|||weekly=50", true},
+		{"|||weekly=100", false},
+	} {
+		l, err := parseLimit(testcase.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exceeded := l.isExceeded(r); exceeded != testcase.exceeded {
+			t.Errorf("%s expect %v; got %v", testcase.limit, testcase.exceeded, exceeded)
+		}
+	}
+	r.roll(w, date(1, 19, 9).AddDate(0, 0, historyDays+10))
+	if n := len(r.download.history); n != historyDays {
+		t.Errorf("expect %d days of history; got %d", historyDays, n)
+	}
+}
+
+func TestPool(t *testing.T) {
+	ts := httptest.NewServer(testHandler)
+	defer ts.Close()
+	m := map[string]string{"Hello": "world"}
+
+	s := NewServer(NewBase("", getPort(t)))
+	go s.Run()
+	defer s.Shutdown(context.Background())
+	time.Sleep(time.Second)
+
+	dead := parseProxy("http://localhost:" + getPort(t))
+	c, err := NewClient(NewBase("", getPort(t)), dead, parseProxy("http://localhost:"+s.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetHealthCheck(strings.TrimPrefix(ts.URL, "http://"), time.Hour)
+	go c.Run()
+	defer c.Shutdown(context.Background())
+	time.Sleep(time.Second)
+
+	for range 2 {
+		testProxy(t, c.Port, ts.URL, m)
+	}
+	if !c.proxy.upstreams[0].down.Load() {
+		t.Error("expect dead upstream down")
+	}
+	if c.proxy.upstreams[1].down.Load() {
+		t.Error("expect upstream up")
+	}
+	var b strings.Builder
+	c.proxy.WriteStatus(&b)
+	if expect := dead.Redacted() + "   down"; !strings.Contains(b.String(), expect) {
+		t.Errorf("expect %q in status; got %s", expect, b.String())
+	}
+
+	c.proxy.upstreams[0].down.Store(false)
+	if conn, err := c.proxy.Dial("tcp", strings.TrimPrefix(ts.URL, "http://")); err != nil {
+		t.Error(err)
+	} else {
+		conn.Close()
+	}
+	if n := c.proxy.upstreams[0].failures.Load(); n == 0 {
+		t.Error("expect failures of dead upstream")
+	}
+
+	forbidden := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer forbidden.Close()
+	p, _ := NewPool(parseProxy(forbidden.URL), parseProxy("http://localhost:"+s.Port))
+	p.strategy = LeastConn
+	if _, err := p.Dial("tcp", strings.TrimPrefix(ts.URL, "http://")); err == nil {
+		t.Error("expect refused dial not to fall over; got nil")
+	}
+	if n := p.upstreams[0].failures.Load(); n != 0 {
+		t.Errorf("expect no failures of refusing upstream; got %d", n)
+	}
+
+	p, _ = NewPool(parseProxy("http://localhost:1"), parseProxy("http://localhost:2"))
+	p.strategy = LeastConn
+	p.upstreams[0].active.Store(1)
+	if u := p.pick(nil); u != p.upstreams[1] {
+		t.Errorf("expect least connections upstream; got %s", u.u)
+	}
+	p.strategy = Latency
+	p.upstreams[0].latency.Store(int64(time.Second))
+	p.upstreams[1].latency.Store(int64(time.Millisecond))
+	var n int
+	for range 100 {
+		if p.pick(nil) == p.upstreams[1] {
+			n++
+		}
+	}
+	if n < 90 {
+		t.Errorf("expect lower latency upstream picked mostly; got %d/100", n)
+	}
+}
+
+func TestSOCKS(t *testing.T) {
+	ts := httptest.NewServer(testHandler)
+	defer ts.Close()
+	m := map[string]string{"Hello": "world"}
+	account := auth.Basic{Username: "socks", Password: "password"}
+
+	s := NewServer(NewBase("", getPort(t)))
+	s.accounts.Store(account, &limit{speed: limiter.New(limiter.Inf)})
+	go s.Run()
+	defer s.Shutdown(context.Background())
+	ss := s.SOCKS(getPort(t))
+	go ss.Run()
+	defer ss.Close()
+
+	c, _ := NewClient(NewBase("", getPort(t)), parseProxy("http://localhost:"+s.Port))
+	c.SetProxyAuth(&proxy.Auth{User: account.Username, Password: account.Password})
+	cs := c.SOCKS(getPort(t))
+	go cs.Run()
+	defer cs.Close()
+	time.Sleep(time.Second)
+
+	for i, testcase := range []struct {
+		port string
+		auth *proxy.Auth
+		ok   bool
+	}{
+		{ss.Port, nil, false},
+		{ss.Port, &proxy.Auth{User: account.Username, Password: "wrong"}, false},
+		{ss.Port, &proxy.Auth{User: account.Username, Password: account.Password}, true},
+		{cs.Port, nil, true},
+	} {
+		d, _ := proxy.SOCKS5("tcp", "localhost:"+testcase.port, testcase.auth, nil)
+		_, res, err := do(d, ts.URL, newRequest(ts.URL, m))
+		if !testcase.ok {
+			if err == nil {
+				t.Errorf("#%d expect error; got nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d %v", i, err)
+		} else if !maps.Equal(m, res) {
+			t.Errorf("#%d expect %v; got %v", i, m, res)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if v, ok := recordMap.Load(user{account.Username, false}); !ok || v.download.total.Get() == 0 {
+		t.Error("expect traffic of socks account recorded")
+	}
+
+	closed := s.SOCKS(getPort(t))
+	closed.Close()
+	if err := closed.Run(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", ":"+closed.Port)
+	if err != nil {
+		t.Fatal("expect listener of closed socks released:", err)
+	}
+	l.Close()
+}
+
+func TestTransparent(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("transparent proxy is only supported on linux")
+	}
+	c, _ := NewClient(NewBase("", getPort(t)), parseProxy("http://localhost:8080"))
+	tp := c.Transparent(getPort(t), false)
+	tp.Close()
+	if err := tp.Run(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", ":"+tp.Port)
+	if err != nil {
+		t.Fatal("expect listener of closed transparent proxy released:", err)
+	}
+	l.Close()
+}
+
+func testRoutes(list, custom string) []route {
+	sources, _ := parseSources("", autoproxyFilter)
+	sources[0].set(list)
+	return buildRoutes(parseCustom(custom), sources)
+}
+
+func TestPAC(t *testing.T) {
+	routes := testRoutes("domain:google.com\nfull:www.example.com\ndomain:baidu.com:@cn\nkeyword:twitter\nregexp:^ad[0-9]+\\.example\\.net$\n", "*.github.com, 10.0.0.0/8, 1.1.1.1")
+	c, _ := NewClient(NewBase("", "8888"), parseProxy("http://localhost:8080"))
+	c.SetAutoproxy("8889", routes)
+
+	ts := httptest.NewServer(c.autoproxy.Handler)
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/proxy.pac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ns-proxy-autoconfig" {
+		t.Errorf("expect application/x-ns-proxy-autoconfig; got %s", ct)
+	}
+	for _, expect := range []string{
+		`var rules = [{"action":"PROXY 127.0.0.1:8888","zones":{"github.com":1},"hosts":{"1.1.1.1":1},"networks":[["10.0.0.0","255.0.0.0"]],"keywords":[],"regexps":[],"ip":true},` +
+			`{"action":"PROXY 127.0.0.1:8888","zones":{"google.com":1},"hosts":{"www.example.com":1},"networks":[],"keywords":["twitter"],"regexps":["^ad[0-9]+\\.example\\.net$"]}];`,
+		"function FindProxyForURL(url, host)",
+	} {
+		if !strings.Contains(string(b), expect) {
+			t.Errorf("expect %q in PAC; got\n%s", expect, b)
+		}
+	}
+
+	c.autoproxy.update(testRoutes("", "example.org"))
+	resp, err = http.Get(ts.URL + "/proxy.pac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ = io.ReadAll(resp.Body)
+	if expect := `var rules = [{"action":"PROXY 127.0.0.1:8888","zones":{},"hosts":{"example.org":1},`; !strings.Contains(string(b), expect) {
+		t.Errorf("expect %q in PAC; got\n%s", expect, b)
+	}
+}
+
+func TestAutoproxyRules(t *testing.T) {
+	defer func(f func(string) (string, error)) { includeList = f }(includeList)
+	defer func(f func(string) ([]net.IP, error)) { resolveIP = f }(resolveIP)
+	defer clear(routeCache.m)
+	clear(routeCache.m)
+	resolveIP = func(string) ([]net.IP, error) { return nil, errors.New("no such host") }
+	lists := map[string]string{
+		"google":  "domain:google.com\nfull:www.google.cn @cn\ninclude:youtube\n",
+		"youtube": "# comment\nyoutube.com\nkeyword:ytimg @ads\ninclude:google\n",
+	}
+	includeList = func(name string) (string, error) {
+		if s, ok := lists[name]; ok {
+			return s, nil
+		}
+		return "", errors.New("not found")
+	}
+	routes := testRoutes(`domain:example.com
+full:www.example.org:@ads
+domain:example.cn:@ads,@cn
+keyword:twitter
+regexp:^ad[0-9]+\.example\.net$
+`, `include:google @-ads
+regexp:(^|\.)facebook\.com$
+*.github.com, 1.1.1.1
+10.0.0.0/8 # private
+`)
+	for host, expect := range map[string]bool{
+		"example.com":       true,
+		"www.example.com":   true,
+		"www.example.org":   true,
+		"example.org":       false,
+		"example.cn":        false,
+		"api.twitter.com":   true,
+		"ad12.example.net":  true,
+		"ad.example.net":    false,
+		"mail.google.com":   true,
+		"www.google.cn":     true,
+		"m.youtube.com":     true,
+		"i.ytimg.com":       false,
+		"www.facebook.com":  true,
+		"facebook.com.cn":   false,
+		"api.github.com":    true,
+		"1.1.1.1":           true,
+		"10.1.2.3":          true,
+		"8.8.8.8":           false,
+		"WWW.EXAMPLE.COM.":  true,
+		"notexample.com":    false,
+		"example.com.other": false,
+	} {
+		if got := lookup(routes, host) == UseProxy; got != expect {
+			t.Errorf("%s: expect %v; got %v", host, expect, got)
+		}
+	}
+
+	f, err := parseAttrFilter("@ads, @-cn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.match([]string{"ads"}) || f.match([]string{"ads", "cn"}) || f.match(nil) {
+		t.Error("unexpected attribute filter result")
+	}
+	if _, err := parseAttrFilter("cn"); err == nil {
+		t.Error("expect error for attribute without @")
+	}
+}
+
+func TestAutoproxySources(t *testing.T) {
+	defer func(f func(string) ([]net.IP, error)) { resolveIP = f }(resolveIP)
+	defer clear(routeCache.m)
+	clear(routeCache.m)
+	resolveIP = func(string) ([]net.IP, error) { return nil, errors.New("no such host") }
+	sources, err := parseSources("gfwlist.txt#format=gfwlist&interval=1h, https://example.com/cn.txt#format=plain&action=direct", autoproxyFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 2 {
+		t.Fatalf("expect 2 sources; got %d", len(sources))
+	}
+	if s := sources[0]; s.isURL() || s.format != formatGFWList || s.outbound != UseProxy || s.interval != time.Hour {
+		t.Errorf("unexpected source: %s %s %s %s", s.location, s.format, s.outbound, s.interval)
+	}
+	if s := sources[1]; !s.isURL() || s.format != formatPlain || s.outbound != UseDirect || s.interval != autoproxyInterval {
+		t.Errorf("unexpected source: %s %s %s %s", s.location, s.format, s.outbound, s.interval)
+	}
+	for _, s := range []string{"list.txt#format=unknown", "list.txt#interval=abc", "list.txt#interval=0s", "list.txt#attrs=cn"} {
+		if _, err := parseSources(s, autoproxyFilter); err == nil {
+			t.Errorf("%s: expect error", s)
+		}
+	}
+
+	sources[0].set(base64.StdEncoding.EncodeToString([]byte(`[AutoProxy 0.2.9]
+! comment
+||google.com
+|http://www.example.org/path
+.twitter.com
+*.wikipedia.org
+||1.2.3.4
+@@||cn.google.com
+/^https?:\/\/[^\/]+blogspot\.(.*)/
+||facebook.com^$third-party
+`)))
+	sources[1].set("# china\nbaidu.com\n*.qq.com\ntwitter.cn\n114.114.114.0/24\n")
+	routes := buildRoutes(parseCustom("maps.baidu.com"), sources)
+	for host, expect := range map[string]DialerType{
+		"google.com":        UseProxy,
+		"mail.google.com":   UseProxy,
+		"cn.google.com":     UseDirect,
+		"www.cn.google.com": UseDirect,
+		"www.example.org":   UseProxy,
+		"example.org":       UseDirect,
+		"api.twitter.com":   UseProxy,
+		"en.wikipedia.org":  UseProxy,
+		"1.2.3.4":           UseProxy,
+		"www.facebook.com":  UseProxy,
+		"x.blogspot.com":    UseDirect,
+		"www.baidu.com":     UseDirect,
+		"maps.baidu.com":    UseProxy,
+		"im.qq.com":         UseDirect,
+		"114.114.114.114":   UseDirect,
+		"unknown.com":       UseDirect,
+	} {
+		if got := lookup(routes, host); got != expect {
+			t.Errorf("%s: expect %s; got %s", host, expect, got)
+		}
+	}
+}
+
+func TestOutbound(t *testing.T) {
+	ts := httptest.NewServer(testHandler)
+	defer ts.Close()
+
+	s := NewServer(NewBase("", getPort(t)))
+	go s.Run()
+	defer s.Shutdown(context.Background())
+	time.Sleep(time.Second)
+
+	c, _ := NewClient(NewBase("", getPort(t)), parseProxy("http://localhost:"+getPort(t)))
+	outbounds, err := parseOutbounds("alt=http://localhost:" + s.Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources, _ := parseSources("alt.txt#format=plain&action=alt, ads.txt#format=plain&action=reject", autoproxyFilter)
+	if err := checkOutbounds(sources, outbounds); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkOutbounds(sources, nil); err == nil {
+		t.Error("expect error for unknown outbound")
+	}
+	for name, u := range outbounds {
+		if err := c.SetOutbound(name, u...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sources[0].set("127.0.0.1\n")
+	sources[1].set("10.0.0.0/8\n")
+	c.SetAutoproxy(getPort(t), buildRoutes(nil, sources))
+	go c.Run()
+	defer c.Shutdown(context.Background())
+	time.Sleep(time.Second)
+
+	conn, err := c.autoproxy.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if typ, _ := IsTyped(conn, nil); typ != "alt" {
+		t.Errorf("expect alt outbound; got %s", typ)
+	}
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(parseProxy("http://localhost:" + c.autoproxy.Port))}}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expect status 200 through alt outbound; got %d", resp.StatusCode)
+	}
+	resp, err = client.Get("http://10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expect status 403 for rejected destination; got %d", resp.StatusCode)
+	}
+
+	var b strings.Builder
+	c.autoproxy.RLock()
+	writePAC(&b, "127.0.0.1:"+c.Port, "127.0.0.1:"+c.autoproxy.Port, c.autoproxy.routes)
+	c.autoproxy.RUnlock()
+	if expect := `"action":"PROXY 127.0.0.1:` + c.autoproxy.Port + `","zones":{},"hosts":{"127.0.0.1":1}`; !strings.Contains(b.String(), expect) {
+		t.Errorf("expect %q in PAC; got\n%s", expect, b.String())
+	}
+
+	for _, s := range []string{"proxy=http://localhost:1", "alt", "alt=", "a=http://localhost:1;a=http://localhost:2"} {
+		if _, err := parseOutbounds(s); err == nil {
+			t.Errorf("%s: expect error", s)
+		}
+	}
+}
+
+func TestGeoIP(t *testing.T) {
+	defer func(f func(string) ([]net.IP, error)) { resolveIP = f }(resolveIP)
+	defer clear(routeCache.m)
+	clear(routeCache.m)
+	var resolved int
+	resolveIP = func(host string) ([]net.IP, error) {
+		resolved++
+		switch host {
+		case "cn.example":
+			return []net.IP{net.ParseIP("114.114.114.114")}, nil
+		case "lan.example":
+			return []net.IP{net.ParseIP("192.168.1.1")}, nil
+		}
+		return []net.IP{net.ParseIP("8.8.8.8")}, nil
+	}
+
+	field := func(num int, v []byte) []byte {
+		b := binary.AppendUvarint(nil, uint64(num<<3|2))
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		return append(b, v...)
+	}
+	cidr := func(s string) []byte {
+		_, network, _ := net.ParseCIDR(s)
+		ones, _ := network.Mask.Size()
+		ip := network.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return append(field(1, ip), append([]byte{2 << 3}, byte(ones))...)
+	}
+	geoip := func(code string, cidrs ...string) []byte {
+		b := field(1, []byte(code))
+		for _, i := range cidrs {
+			b = append(b, field(2, cidr(i))...)
+		}
+		return field(1, b)
+	}
+	var dat []byte
+	dat = append(dat, geoip("CN", "114.114.0.0/16", "240e::/20")...)
+	dat = append(dat, geoip("US", "8.8.8.0/24")...)
+
+	sources, err := parseSources("geoip.dat#format=geoip&country=cn, lan.txt#format=plain&action=direct, list.txt", autoproxyFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources[0].outbound = UseDirect
+	sources[0].set(string(dat))
+	sources[1].set("192.168.0.0/16\n")
+	sources[2].set("domain:cn.example\n")
+	routes := buildRoutes(nil, sources)
+	for host, expect := range map[string]DialerType{
+		"114.114.1.1":    UseDirect,
+		"240e::1":        UseDirect,
+		"8.8.8.8":        UseDirect,
+		"cn.example":     UseProxy,
+		"www.cn.example": UseProxy,
+		"lan.example":    UseDirect,
+		"other.example":  UseDirect,
+	} {
+		if got := lookup(routes, host); got != expect {
+			t.Errorf("%s: expect %s; got %s", host, expect, got)
+		}
+	}
+	if !routes[0].rules.match("114.114.1.1") || routes[0].rules.match("8.8.8.8") {
+		t.Error("unexpected geoip rules")
+	}
+
+	sources, _ = parseSources("lan.txt#format=plain&action=reject", autoproxyFilter)
+	sources[0].set("192.168.0.0/16\n")
+	if got := lookup(buildRoutes(nil, sources), "lan.example"); got != UseReject {
+		t.Errorf("expect resolved address rejected; got %s", got)
+	}
+	if resolved != 2 {
+		t.Errorf("expect each name resolved once; got %d times", resolved)
+	}
+
+	sources, _ = parseSources("lan.txt#format=plain&action=reject&no-resolve", autoproxyFilter)
+	sources[0].set("192.168.0.0/16\n")
+	routes = buildRoutes(nil, sources)
+	if got := lookup(routes, "nocache.example"); got != UseDirect || resolved != 2 {
+		t.Errorf("expect name not resolved for no-resolve source; got %s, %d resolved", got, resolved)
+	}
+	if got := lookup(routes, "192.168.1.1"); got != UseReject {
+		t.Errorf("expect address rejected by no-resolve source; got %s", got)
+	}
+	var pac strings.Builder
+	writePAC(&pac, "proxy", "autoproxy", routes)
+	if !strings.Contains(pac.String(), "var hasIP = false;") {
+		t.Error("expect no dnsResolve in PAC for no-resolve source")
+	}
+
+	if _, err := parseSources("geoip.dat#format=geoip", autoproxyFilter); err == nil {
+		t.Error("expect error for geoip source without country")
+	}
+	if err := readGeoIPDat([]byte{0x0a, 0xff}, func(string, *net.IPNet) {}); err == nil {
+		t.Error("expect error for bad geoip.dat")
+	}
+}
+
+func TestAutoproxyCache(t *testing.T) {
+	defer func(dir string) { autoproxyCache = dir }(autoproxyCache)
+	autoproxyCache = t.TempDir()
+
+	var mu sync.Mutex
+	var requests, notModified int
+	list := "domain:example.com\n"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		etag := strconv.Quote(strconv.Itoa(len(list)))
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		io.WriteString(w, list)
+	}))
+	defer ts.Close()
+
+	c, _ := NewClient(NewBase("", getPort(t)), parseProxy("http://localhost:"+getPort(t)))
+	sources, _ := parseSources(ts.URL+"/list.txt", autoproxyFilter)
+	if _, ok := sources[0].loadCache(); ok {
+		t.Fatal("expect no cache")
+	}
+	if changed, err := sources[0].refresh(c); err != nil {
+		t.Fatal(err)
+	} else if !changed {
+		t.Error("expect changed")
+	}
+	if changed, err := sources[0].refresh(c); err != nil {
+		t.Fatal(err)
+	} else if changed {
+		t.Error("expect not changed")
+	}
+	mu.Lock()
+	if notModified == 0 {
+		t.Error("expect conditional request")
+	}
+	mu.Unlock()
+
+	// restart
+	sources, _ = parseSources(ts.URL+"/list.txt", autoproxyFilter)
+	mu.Lock()
+	n := requests
+	mu.Unlock()
+	fetched, ok := sources[0].loadCache()
+	if !ok {
+		t.Fatal("expect cache")
+	}
+	if time.Since(fetched) > time.Minute {
+		t.Errorf("unexpected fetched time: %s", fetched)
+	}
+	if lookup(buildRoutes(nil, sources), "www.example.com") != UseProxy {
+		t.Error("expect rules loaded from cache")
+	}
+	mu.Lock()
+	if requests != n {
+		t.Error("expect no request when loading cache")
+	}
+	list = "domain:example.com\ndomain:example.org\n"
+	mu.Unlock()
+	if changed, err := sources[0].refresh(c); err != nil {
+		t.Fatal(err)
+	} else if !changed {
+		t.Error("expect changed")
+	}
+	if lookup(buildRoutes(nil, sources), "www.example.org") != UseProxy {
+		t.Error("expect updated rules")
+	}
+}
+
+// dnsAnswer answers queries of names in records, and with NXDOMAIN otherwise.
+func dnsAnswer(t *testing.T, records map[string]string, b []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	h.Response = true
+	ip, ok := records[strings.TrimSuffix(q.Name.String(), ".")]
+	if !ok {
+		h.RCode = dnsmessage.RCodeNameError
+	}
+	builder := dnsmessage.NewBuilder(nil, h)
+	builder.StartQuestions()
+	builder.Question(q)
+	builder.StartAnswers()
+	if addr := net.ParseIP(ip).To4(); ok && q.Type == dnsmessage.TypeA {
+		builder.AResource(
+			dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60},
+			dnsmessage.AResource{A: [4]byte(addr)},
+		)
+	}
+	resp, err := builder.Finish()
+	if err != nil {
+		t.Error(err)
+	}
+	return resp
+}
+
+func TestResolver(t *testing.T) {
+	records := map[string]string{"udp.test": "127.0.0.1", "doh.test": "192.0.2.1"}
+	var mu sync.Mutex
+	var queries int
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			queries++
+			mu.Unlock()
+			pc.WriteTo(dnsAnswer(t, records, b[:n]), addr)
+		}
+	}()
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad content type", http.StatusBadRequest)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(dnsAnswer(t, records, b))
+	}))
+	defer doh.Close()
+
+	if _, err := NewResolver("ftp://127.0.0.1"); err == nil {
+		t.Error("expect error for unsupported upstream")
+	}
+
+	r, err := NewResolver(pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for range 2 {
+		ips, err := r.LookupIP(ctx, "udp.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 1 || ips[0].String() != "127.0.0.1" {
+			t.Errorf("expected [127.0.0.1]; got %v", ips)
+		}
+	}
+	mu.Lock()
+	if queries != 2 { // A and AAAA, then cached
+		t.Errorf("expected 2 queries; got %d", queries)
+	}
+	mu.Unlock()
+	var dnsErr *net.DNSError
+	if _, err := r.LookupIP(ctx, "none.test"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("expected not found; got %v", err)
+	}
+	r.SetHosts([]string{"# comment", "10.0.0.1 udp.test hosts.test"})
+	if ips, _ := r.LookupIP(ctx, "Hosts.Test."); len(ips) != 1 || ips[0].String() != "10.0.0.1" {
+		t.Errorf("expected hosts override; got %v", ips)
+	}
+	if ips, _ := r.LookupIP(ctx, "udp.test"); len(ips) != 1 || ips[0].String() != "10.0.0.1" {
+		t.Errorf("expected hosts override; got %v", ips)
+	}
+
+	r, err = NewResolver(doh.URL + "/dns-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.upstreams[0].(*dohUpstream).client = doh.Client()
+	if ips, err := r.LookupIP(ctx, "doh.test"); err != nil {
+		t.Fatal(err)
+	} else if len(ips) != 1 || ips[0].String() != "192.0.2.1" {
+		t.Errorf("expected [192.0.2.1]; got %v", ips)
+	}
+
+	defer func(r *Resolver) { dnsResolver = r }(dnsResolver)
+	dnsResolver, _ = NewResolver(pc.LocalAddr().String())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	conn, err := dialDirect(ctx, "tcp", net.JoinHostPort("udp.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if _, err := dialDirect(ctx, "tcp", net.JoinHostPort("none.test", port)); err == nil {
+		t.Error("expect error for unknown host")
+	}
+
+	// proxied names are resolved locally only for resolve=local routes
+	sources, err := parseSources("a.txt#format=plain,b.txt#format=plain&resolve=local", autoproxyFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources[0].set("remote.test")
+	sources[1].set("udp.test")
+	routes := buildRoutes(nil, sources)
+	if len(routes) != 2 {
+		t.Fatalf("expected 2 routes; got %d", len(routes))
+	}
+	if r, ok := lookupRoute(routes, "remote.test"); !ok || r.outbound != UseProxy || r.local {
+		t.Errorf("expected remote proxy route; got %v", r)
+	}
+	if r, ok := lookupRoute(routes, "udp.test"); !ok || r.outbound != UseProxy || !r.local {
+		t.Errorf("expected local proxy route; got %v", r)
+	}
+	if _, err := parseSources("a.txt#resolve=proxy", autoproxyFilter); err == nil {
+		t.Error("expect error for unknown resolve")
+	}
+
+	// every address of a locally resolved name is tried
+	defer func(f func(string) ([]net.IP, error)) { resolveIP = f }(resolveIP)
+	resolveIP = func(string) ([]net.IP, error) { return []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.1")}, nil }
+	a := &Autoproxy{routes: routes, dialers: map[DialerType]proxy.Dialer{UseProxy: proxy.Direct, UseDirect: proxy.Direct}}
+	if conn, err := a.Dial("tcp", net.JoinHostPort("udp.test", port)); err != nil {
+		t.Errorf("expect second address dialed; got %v", err)
+	} else {
+		conn.Close()
+	}
+}
+
+func TestSniff(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	for _, tc := range []struct {
+		name  string
+		write func(net.Conn)
+		host  string
+	}{
+		{"tls", func(c net.Conn) {
+			tls.Client(c, &tls.Config{ServerName: "www.example.com"}).Handshake()
+		}, "www.example.com"},
+		{"http", func(c net.Conn) {
+			io.WriteString(c, "GET / HTTP/1.1\r\nHost: example.org:8080\r\n\r\n")
+		}, "example.org"},
+		{"ip", func(c net.Conn) {
+			io.WriteString(c, "GET / HTTP/1.1\r\nHost: 1.2.3.4\r\n\r\n")
+		}, ""},
+		{"other", func(c net.Conn) {
+			io.WriteString(c, "SSH-2.0-OpenSSH\r\n")
+		}, ""},
+	} {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent := make(chan []byte, 1)
+		go tc.write(&recordConn{client, sent})
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, conn := sniffHost(conn)
+		if host != tc.host {
+			t.Errorf("%s: expected %q; got %q", tc.name, tc.host, host)
+		}
+		want := <-sent
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		b := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+		} else if !bytes.Equal(b, want) {
+			t.Errorf("%s: expected replayed bytes", tc.name)
+		}
+		conn.Close()
+		client.Close()
+	}
+}
+
+// recordConn sends the first write to a connection to sent.
+type recordConn struct {
+	net.Conn
+	sent chan []byte
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	select {
+	case c.sent <- bytes.Clone(b):
+	default:
+	}
+	return c.Conn.Write(b)
+}
+
+func TestSniffConnect(t *testing.T) {
+	c, _ := NewClient(NewBase("", getPort(t)), parseProxy("http://localhost:"+getPort(t)))
+	sources, _ := parseSources("ads.txt#format=plain&action=reject", autoproxyFilter)
+	sources[0].set("blocked.test\n")
+	c.SetSniff(true).SetAutoproxy(getPort(t), buildRoutes(nil, sources))
+	go c.Run()
+	defer c.Shutdown(context.Background())
+	time.Sleep(time.Second)
+
+	rejected := func() uint64 {
+		h, ok := metrics.dial.Load(UseReject.String())
+		if !ok {
+			return 0
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.count
+	}
+	n := rejected()
+	conn, err := net.Dial("tcp", "localhost:"+c.autoproxy.Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "CONNECT 127.0.0.1:443 HTTP/1.1\r\nHost: 127.0.0.1:443\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expect status 200; got %d", resp.StatusCode)
+	}
+	go tls.Client(conn, &tls.Config{ServerName: "blocked.test"}).Handshake()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("expect tunnel closed; got %v", err)
+	}
+	if rejected() != n+1 {
+		t.Error("expect sniffed server name rejected")
+	}
+
+	// the main listener dials through the upstream before answering
+	main, err := net.Dial("tcp", "localhost:"+c.Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer main.Close()
+	io.WriteString(main, "CONNECT 127.0.0.1:443 HTTP/1.1\r\nHost: 127.0.0.1:443\r\n\r\n")
+	if resp, err := http.ReadResponse(bufio.NewReader(main), nil); err != nil {
+		t.Fatal(err)
+	} else if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expect status 503 without sniffing; got %d", resp.StatusCode)
+	}
+}
+
+func TestACL(t *testing.T) {
+	ts := httptest.NewServer(testHandler)
+	defer ts.Close()
+	_, tsPort, _ := net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+
+	connectPorts, _ := parsePorts("443")
+	acl := NewACL(connectPorts)
+	s := NewServer(NewBase("", getPort(t))).SetACL(acl)
+	go s.Run()
+	defer s.Shutdown(context.Background())
+	time.Sleep(time.Second)
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(parseProxy("http://localhost:" + s.Port))}}
+	get := func(url string) int {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	connect := func(address string) int {
+		conn, err := net.Dial("tcp", "localhost:"+s.Port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, "CONNECT "+address+" HTTP/1.1\r\nHost: "+address+"\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	for _, tc := range []struct {
+		rules   []string
+		url     string
+		connect string
+		expect  int
+	}{
+		{nil, ts.URL, "", http.StatusForbidden},
+		{nil, "", "127.0.0.1:" + tsPort, http.StatusForbidden},
+		{[]string{"allow 127.0.0.1"}, ts.URL, "", http.StatusOK},
+		{[]string{"allow 127.0.0.1"}, "", "127.0.0.1:" + tsPort, http.StatusOK},
+		{[]string{"allow 127.0.0.1 80,443"}, ts.URL, "", http.StatusForbidden},
+		{[]string{"allow 127.0.0.1 " + tsPort}, ts.URL, "", http.StatusOK},
+		{[]string{"allow localhost"}, "http://localhost:" + tsPort, "", http.StatusOK},
+		{[]string{"allow 127.0.0.0/8 @alice"}, ts.URL, "", http.StatusForbidden},
+		{[]string{"deny 127.0.0.1", "allow *"}, ts.URL, "", http.StatusForbidden},
+		{nil, "", "100.100.100.200:443", http.StatusForbidden},
+		{nil, "", "[64:ff9b::7f00:1]:443", http.StatusForbidden},
+	} {
+		acl.setRules(tc.rules)
+		var code int
+		if tc.url != "" {
+			code = get(tc.url)
+		} else {
+			code = connect(tc.connect)
+		}
+		if code != tc.expect {
+			t.Errorf("%v %s%s: expected %d; got %d", tc.rules, tc.url, tc.connect, tc.expect, code)
+		}
+	}
+
+	for ip, expect := range map[string]bool{
+		"8.8.8.8":              false,
+		"2606:4700:4700::1111": false,
+		"64:ff9b::808:808":     false,
+		"100.100.100.200":      true,
+		"0.1.2.3":              true,
+		"198.18.0.1":           true,
+		"255.255.255.255":      true,
+		"::ffff:10.0.0.1":      true,
+		"64:ff9b::a9fe:a9fe":   true,
+		"64:ff9b:1::1":         true,
+		"2002:c0a8:101::1":     true,
+		"2001:db8::1":          true,
+		"fd00::1":              true,
+	} {
+		if internal := isInternal(net.ParseIP(ip)); internal != expect {
+			t.Errorf("isInternal(%s): expect %v; got %v", ip, expect, internal)
+		}
+	}
+
+	// a name resolving to an internal address when dialed is still denied
+	defer func(f func(string) ([]net.IP, error)) { resolveIP = f }(resolveIP)
+	resolveIP = func(string) ([]net.IP, error) { return []net.IP{net.ParseIP("8.8.8.8")}, nil }
+	defer func(r *Resolver) { dnsResolver = r }(dnsResolver)
+	dnsResolver, _ = NewResolver("")
+	dnsResolver.SetHosts([]string{"127.0.0.1 rebind.test"})
+	acl.setRules(nil)
+	ctx, err := acl.check(context.Background(), user{}, "rebind.test:"+tsPort, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialDirect(ctx, "tcp", "rebind.test:"+tsPort); err == nil {
+		t.Error("expect rebound address denied")
+	} else if d := denied(""); !errors.As(err, &d) {
+		t.Errorf("expect denied error; got %v", err)
+	}
+
+	for _, s := range []string{"allow", "permit *", "allow * 1-2-3", "allow * 80 443", "allow * 70000"} {
+		if _, err := parseACLRule(s); err == nil {
+			t.Errorf("%s: expect error", s)
+		}
+	}
+}
+
+func TestCaps(t *testing.T) {
+	ts := httptest.NewServer(testHandler)
+	defer ts.Close()
+	target := strings.TrimPrefix(ts.URL, "http://")
+
+	for _, tc := range []struct{ limit, expect string }{
+		{"1G:20G|1M|20:5", "1GB:20GB|1MB|20:5"},
+		{"||100", "||100"},
+		{"|1K|:0.5", "|1KB|:0.5"},
+	} {
+		l, err := parseLimit(tc.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := l.String(); s != tc.expect {
+			t.Errorf("expect %s; got %s", tc.expect, s)
+		}
+	}
+	for _, s := range []string{"||a", "||-1", "||:0", "||||"} {
+		if _, err := parseLimit(s); err == nil {
+			t.Errorf("%s: expect error", s)
+		}
+	}
+
+	conns := auth.Basic{Username: "conns", Password: "password"}
+	rps := auth.Basic{Username: "rps", Password: "password"}
+	s := NewServer(NewBase("", getPort(t)))
+	l, _ := parseLimit("||1")
+	s.accounts.Store(conns, l)
+	l, _ = parseLimit("||:1")
+	s.accounts.Store(rps, l)
+	go s.Run()
+	defer s.Shutdown(context.Background())
+	time.Sleep(time.Second)
+
+	d, _ := httpproxy.NewDialer(":"+s.Port, nil, &proxy.Auth{User: conns.Username, Password: conns.Password}, nil)
+	conn, err := d.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Dial("tcp", target); err == nil || !strings.Contains(err.Error(), "429") {
+		t.Errorf("expect 429 Too Many Requests; got %v", err)
+	}
+	var b strings.Builder
+	writeUsages(s.Base, &b)
+	if !regexp.MustCompile(`(?m)^conns .* 1$`).MatchString(b.String()) {
+		t.Errorf("expect 1 connection in status; got\n%s", b.String())
+	}
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	if conn, err := d.Dial("tcp", target); err != nil {
+		t.Errorf("expect connection after the first closed; got %v", err)
+	} else {
+		conn.Close()
+	}
+
+	d, _ = httpproxy.NewDialer(":"+s.Port, nil, &proxy.Auth{User: rps.Username, Password: rps.Password}, nil)
+	if conn, err := d.Dial("tcp", target); err != nil {
+		t.Fatal(err)
+	} else {
+		conn.Close()
+	}
+	if _, err := d.Dial("tcp", target); err == nil || !strings.Contains(err.Error(), "429") {
+		t.Errorf("expect 429 Too Many Requests; got %v", err)
+	}
+}
+
+func TestShaper(t *testing.T) {
+	for _, tc := range []struct{ total, listeners string }{
+		{"bad", ""},
+		{"", "main"},
+		{"", "other=1MB"},
+		{"", "main=bad"},
+	} {
+		if _, _, err := parseBandwidth(tc.total, tc.listeners); err == nil {
+			t.Errorf("parseBandwidth(%q, %q): expect error", tc.total, tc.listeners)
+		}
+	}
+
+	// a user with three connections gets the same share as one with one
+	s := NewShaper()
+	s.set(0, map[string]unit.ByteSize{"main": 256 << 10})
+	var a, b atomic.Int64
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	for i, key := range []string{"a", "a", "a", "b"} {
+		n := &a
+		if i == 3 {
+			n = &b
+		}
+		f := s.join("main", key, nil)
+		wg.Go(func() {
+			defer f.leave()
+			w := f.Writer(io.Discard)
+			buf := make([]byte, 16<<10)
+			for !stop.Load() {
+				w.Write(buf)
+				n.Add(int64(len(buf)))
+			}
+		})
+	}
+	time.Sleep(2 * time.Second)
+	stop.Store(true)
+	sa, sb := a.Load(), b.Load()
+	wg.Wait()
+	if sb < sa*2/3 || sb > sa*3/2 {
+		t.Errorf("expect fair shares; got %d and %d", sa, sb)
+	}
+	if sum := sa + sb; sum > 3*256<<10 {
+		t.Errorf("expect at most %d bytes under the listener cap; got %d", 3*256<<10, sum)
+	}
+	if n := len(s.listeners["main"].children); n != 0 {
+		t.Errorf("expect no users after leave; got %d", n)
+	}
+
+	defer func(file, total, listeners string) {
+		configFile = file
+		shaper.set(0, nil)
+		if *bandwidth != total || *listenerBW != listeners {
+			t.Errorf("expect bandwidth flags untouched; got %q and %q", *bandwidth, *listenerBW)
+		}
+	}(configFile, *bandwidth, *listenerBW)
+	config := filepath.Join(t.TempDir(), "config.ini")
+	if err := os.WriteFile(config, []byte("port = 1080\nbandwidth = 1MB\nlistener-bandwidth = \"main=2MB, socks=512KB\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configFile = config
+	if err := reloadShaper(); err != nil {
+		t.Fatal(err)
+	}
+	if lim := shaper.global.lim.Load(); lim == nil || lim.Limit() != 1<<20 {
+		t.Errorf("expect global cap of 1MB; got %v", lim)
+	}
+	if lim := shaper.listeners["socks"].lim.Load(); lim == nil || lim.Limit() != 512<<10 {
+		t.Errorf("expect socks cap of 512KB; got %v", lim)
+	}
+	if lim := shaper.listeners["autoproxy"].lim.Load(); lim != nil {
+		t.Errorf("expect no autoproxy cap; got %v", lim.Limit())
+	}
+	if err := os.WriteFile(config, []byte("port = 1080\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadShaper(); err != nil {
+		t.Fatal(err)
+	}
+	if lim := shaper.global.lim.Load(); lim != nil {
+		t.Errorf("expect global cap removed; got %v", lim.Limit())
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	if th, err := parseThresholds("100, 80%,80", ","); err != nil || !slices.Equal(th, []int{80, 100}) {
+		t.Errorf("expect [80 100]; got %v %v", th, err)
+	}
+	for _, s := range []string{"a", "0", "-5"} {
+		if _, err := parseThresholds(s, ","); err == nil {
+			t.Errorf("%s: expect error", s)
+		}
+	}
+
+	events := make(chan quotaEvent, 10)
+	var attempts atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail the first attempt to be retried
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var e quotaEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		events <- e
+	}))
+	defer ts.Close()
+	var script, output string
+	if runtime.GOOS != "windows" {
+		dir := t.TempDir()
+		script, output = filepath.Join(dir, "hook.sh"), filepath.Join(dir, "output")
+		if err := os.WriteFile(script, []byte("#!/bin/sh\necho $HTTPPROXY_USER $HTTPPROXY_WINDOW $HTTPPROXY_THRESHOLD >> "+output+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(d time.Duration) { webhookBackoff, notifier = d, nil }(webhookBackoff)
+	webhookBackoff = 10 * time.Millisecond
+	notifier = NewNotifier(ts.URL, script)
+
+	base := NewBase("", "")
+	l, err := parseLimit("1K|||warn=50+100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := l.String(); s != "1KB|||warn=50+100" {
+		t.Errorf("expect 1KB|||warn=50+100; got %s", s)
+	}
+	base.accounts.Store(auth.Basic{Username: "warn", Password: "password"}, l)
+	u := user{"warn", false}
+	defer recordMap.Delete(u)
+	w := count(u, io.Discard)
+	expect := func(threshold int, used int64) {
+		t.Helper()
+		select {
+		case e := <-events:
+			if e.User != "warn" || e.Window != "monthly" || e.Quota != "download" || e.Threshold != threshold || e.Used != used || e.Limit != 1024 {
+				t.Errorf("expect %d%% warning of %d bytes; got %+v", threshold, used, e)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expect %d%% warning", threshold)
+		}
+	}
+
+	w.Write(make([]byte, 600))
+	checkQuotas(base)
+	expect(50, 600)
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("expect 2 attempts; got %d", n)
+	}
+	w.Write(make([]byte, 100))
+	checkQuotas(base)
+	w.Write(make([]byte, 400))
+	checkQuotas(base)
+	expect(100, 1100)
+	select {
+	case e := <-events:
+		t.Errorf("expect no more warnings; got %+v", e)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if v, _ := recordMap.Load(u); v.warned != [3]int{0, 0, 100} {
+		t.Errorf("expect warned threshold saved; got %v", v.warned)
+	}
+
+	if script != "" {
+		var b []byte
+		for range 20 {
+			if b, _ = os.ReadFile(output); strings.Count(string(b), "\n") == 2 {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		// the scripts of the warnings run concurrently
+		if lines := strings.Split(strings.TrimSpace(string(b)), "\n"); !slices.Equal(slices.Sorted(slices.Values(lines)), []string{"warn monthly 100", "warn monthly 50"}) {
+			t.Errorf("expect script run twice; got %q", b)
+		}
+	}
+}
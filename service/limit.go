@@ -2,6 +2,8 @@ package main
 
 import (
 	"errors"
+	"math"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,42 +14,194 @@ import (
 
 type limit struct {
 	daily   unit.ByteSize
+	weekly  unit.ByteSize
 	monthly unit.ByteSize
-	speed   *limiter.Limiter
-	st      *rate.Sometimes
+	quota   quota
+	window  window
+	// thresholds of quota warnings in percent, nil for quotaWarnings
+	warn  []int
+	speed *limiter.Limiter
+	st    *rate.Sometimes
+	// caps of concurrent connections and requests per second, zero or nil
+	// for none
+	conns int
+	rps   *rate.Limiter
+}
+
+// quota selects the traffic counted against the daily and monthly limits.
+type quota int
+
+const (
+	quotaDownload quota = iota
+	quotaUpload
+	quotaSum
+)
+
+var quotaList = map[quota]string{
+	quotaDownload: "download",
+	quotaUpload:   "upload",
+	quotaSum:      "sum",
+}
+
+func (q quota) String() string {
+	return quotaList[q]
+}
+
+func parseQuota(s string) (quota, error) {
+	for q, name := range quotaList {
+		if name == s {
+			return q, nil
+		}
+	}
+	return 0, errors.New("unknown quota: " + s)
+}
+
+// usage returns the traffic of record counted by the quota in the periods
+// of w.
+func (q quota) usage(record *record, w window) (today, weekly, monthly int64) {
+	record.mu.Lock()
+	defer record.mu.Unlock()
+	var cs []*counters
+	if q != quotaUpload {
+		cs = append(cs, &record.download)
+	}
+	if q != quotaDownload {
+		cs = append(cs, &record.upload)
+	}
+	for _, c := range cs {
+		today += c.today.Get()
+		weekly += c.weekly.Get()
+		if w.rolling != 0 {
+			monthly += c.last(w.rolling)
+		} else {
+			monthly += c.monthly.Get()
+		}
+	}
+	return
+}
+
+// window sets the periods of quotas. Weeks start on Monday, and months on
+// day reset, or on the last day of shorter months. A rolling window makes
+// the monthly quota count the last rolling days instead.
+type window struct {
+	reset   int
+	rolling int
+	loc     *time.Location
+}
+
+func (w window) location() *time.Location {
+	if w.loc == nil {
+		return time.Local
+	}
+	return w.loc
+}
+
+// day returns the start of the day of t.
+func (w window) day(t time.Time) time.Time {
+	y, m, d := t.In(w.location()).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, w.location())
+}
+
+// week returns the start of the week of t.
+func (w window) week(t time.Time) time.Time {
+	day := w.day(t)
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+// month returns the start of the month of t.
+func (w window) month(t time.Time) time.Time {
+	y, m, d := w.day(t).Date()
+	if d < resetDay(y, m, w.reset) {
+		m--
+	}
+	return time.Date(y, m, resetDay(y, m, w.reset), 0, 0, 0, 0, w.location())
+}
+
+// resetDay returns the day month m of year y starts on for reset.
+func resetDay(y int, m time.Month, reset int) int {
+	return min(max(reset, 1), time.Date(y, m+1, 0, 0, 0, 0, 0, time.UTC).Day())
+}
+
+// parseWindow parses the period options of a limit, separated by commas:
+// weekly=size, reset=day, rolling=days, tz=zone and warn=percent[+...].
+func (l *limit) parseWindow(s string) error {
+	for i := range strings.SplitSeq(s, ",") {
+		if i = strings.TrimSpace(i); i == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(i, "=")
+		value = strings.TrimSpace(value)
+		var err error
+		switch strings.TrimSpace(key) {
+		case "weekly":
+			l.weekly, err = unit.ParseByteSize(value)
+		case "reset":
+			if l.window.reset, err = strconv.Atoi(value); err == nil && (l.window.reset < 1 || l.window.reset > 31) {
+				err = errors.New("bad reset day: " + value)
+			}
+		case "rolling":
+			if l.window.rolling, err = strconv.Atoi(value); err == nil && (l.window.rolling < 1 || l.window.rolling > historyDays+1) {
+				err = errors.New("bad rolling days: " + value)
+			}
+		case "tz":
+			l.window.loc, err = time.LoadLocation(value)
+		case "warn":
+			if l.warn, err = parseThresholds(value, "+"); err == nil && l.warn == nil {
+				l.warn = []int{}
+			}
+		default:
+			err = errors.New("unknown limit option: " + i)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func parseLimit(s string) (*limit, error) {
 	var lim *limiter.Limiter
 	res := strings.Split(s, "|")
-	switch len(res) {
-	case 1:
+	if len(res) > 4 {
+		return nil, errors.New("failed to parse limit")
+	}
+	if len(res) == 1 || strings.TrimSpace(res[1]) == "" {
 		lim = limiter.New(limiter.Inf)
-	case 2:
-		if s := strings.TrimSpace(res[1]); s == "" {
-			lim = limiter.New(limiter.Inf)
-		} else {
-			bs, err := unit.ParseByteSize(s)
-			if err != nil {
-				return nil, err
-			}
-			lim = limiter.New(limiter.Limit(bs))
+	} else {
+		bs, err := unit.ParseByteSize(strings.TrimSpace(res[1]))
+		if err != nil {
+			return nil, err
 		}
-	default:
-		return nil, errors.New("failed to parse limit")
+		lim = limiter.New(limiter.Limit(bs))
+	}
+	l := &limit{speed: lim}
+	if len(res) >= 3 {
+		if err := l.parseCaps(res[2]); err != nil {
+			return nil, err
+		}
+	}
+	if len(res) == 4 {
+		if err := l.parseWindow(res[3]); err != nil {
+			return nil, err
+		}
+	}
+	if before, after, found := strings.Cut(res[0], "@"); found {
+		var err error
+		if l.quota, err = parseQuota(strings.TrimSpace(after)); err != nil {
+			return nil, err
+		}
+		res[0] = before
 	}
 	res = strings.Split(res[0], ":")
 	switch len(res) {
 	case 1:
-		s := strings.TrimSpace(res[0])
-		if s == "" {
-			return &limit{0, 0, lim, nil}, nil
-		}
-		monthly, err := unit.ParseByteSize(s)
-		if err != nil {
-			return nil, err
+		if s := strings.TrimSpace(res[0]); s != "" {
+			monthly, err := unit.ParseByteSize(s)
+			if err != nil {
+				return nil, err
+			}
+			l.monthly = monthly
 		}
-		return &limit{0, monthly, lim, newSometimes(time.Minute)}, nil
 	case 2:
 		daily, err := unit.ParseByteSize(res[0])
 		if err != nil {
@@ -57,18 +211,136 @@ func parseLimit(s string) (*limit, error) {
 		if err != nil {
 			return nil, err
 		}
-		return &limit{daily, monthly, lim, newSometimes(time.Minute)}, nil
+		l.daily, l.monthly = daily, monthly
 	default:
 		return nil, errors.New("failed to parse limit")
 	}
+	if l.hasQuota() || l.conns != 0 || l.rps != nil {
+		l.st = newSometimes(time.Minute)
+	}
+	return l, nil
+}
+
+// parseCaps parses the caps of concurrent connections and requests per
+// second as conns[:rps], either of which may be empty for no cap.
+func (l *limit) parseCaps(s string) error {
+	conns, rps, _ := strings.Cut(s, ":")
+	if conns = strings.TrimSpace(conns); conns != "" {
+		n, err := strconv.Atoi(conns)
+		if err != nil || n < 0 {
+			return errors.New("bad connection cap: " + conns)
+		}
+		l.conns = n
+	}
+	if rps = strings.TrimSpace(rps); rps != "" {
+		r, err := strconv.ParseFloat(rps, 64)
+		if err != nil || r <= 0 {
+			return errors.New("bad request rate cap: " + rps)
+		}
+		l.rps = rate.NewLimiter(rate.Limit(r), max(1, int(math.Ceil(r))))
+	}
+	return nil
+}
+
+// String formats the limit in the syntax accepted by parseLimit.
+func (limit limit) String() string {
+	var s string
+	switch {
+	case limit.daily == 0 && limit.monthly == 0:
+	case limit.daily == 0:
+		s = formatSize(limit.monthly)
+	default:
+		s = formatSize(limit.daily) + ":" + formatSize(limit.monthly)
+	}
+	if limit.hasQuota() && limit.quota != quotaDownload {
+		s += "@" + limit.quota.String()
+	}
+	var speed, caps string
+	if limit.speed != nil && limit.speed.Limit() != limiter.Inf {
+		speed = formatSize(unit.ByteSize(limit.speed.Limit()))
+	}
+	if limit.conns != 0 {
+		caps = strconv.Itoa(limit.conns)
+	}
+	if limit.rps != nil {
+		caps += ":" + strconv.FormatFloat(float64(limit.rps.Limit()), 'f', -1, 64)
+	}
+	var opts []string
+	if limit.weekly != 0 {
+		opts = append(opts, "weekly="+formatSize(limit.weekly))
+	}
+	if limit.window.reset > 1 {
+		opts = append(opts, "reset="+strconv.Itoa(limit.window.reset))
+	}
+	if limit.window.rolling != 0 {
+		opts = append(opts, "rolling="+strconv.Itoa(limit.window.rolling))
+	}
+	if limit.window.loc != nil {
+		opts = append(opts, "tz="+limit.window.loc.String())
+	}
+	if limit.warn != nil {
+		warn := make([]string, len(limit.warn))
+		for i, n := range limit.warn {
+			warn[i] = strconv.Itoa(n)
+		}
+		opts = append(opts, "warn="+strings.Join(warn, "+"))
+	}
+	parts := []string{s, speed, caps, strings.Join(opts, ",")}
+	for len(parts) > 1 && parts[len(parts)-1] == "" {
+		parts = parts[:len(parts)-1]
+	}
+	return strings.Join(parts, "|")
+}
+
+// formatSize formats n in a human-readable form if it parses back exactly.
+func formatSize(n unit.ByteSize) string {
+	if s := n.String(); unit.MustParseByteSize(s) == n {
+		return s
+	}
+	return strconv.FormatInt(int64(n), 10)
+}
+
+// hasQuota reports whether the limit has a traffic quota.
+func (limit limit) hasQuota() bool {
+	return limit.daily != 0 || limit.weekly != 0 || limit.monthly != 0
 }
 
 func (limit limit) isExceeded(record *record) bool {
-	if limit.daily == 0 && limit.monthly == 0 {
+	if !limit.hasQuota() {
 		return false
 	}
-	if limit.daily == 0 || record.today.Get() < int64(limit.daily) {
-		return record.monthly.Get() >= int64(limit.monthly)
+	today, weekly, monthly := limit.quota.usage(record, limit.window)
+	return limit.daily != 0 && today >= int64(limit.daily) ||
+		limit.weekly != 0 && weekly >= int64(limit.weekly) ||
+		limit.monthly != 0 && monthly >= int64(limit.monthly)
+}
+
+// enter takes a connection of u within the caps of l, which is given back
+// by leave. It returns the reason if u is over a cap.
+func enter(u user, l *limit) (string, bool) {
+	if u.name == "" {
+		return "", true
+	}
+	if l != nil && l.rps != nil && !l.rps.Allow() {
+		return "too many requests", false
 	}
-	return record.today.Get() >= int64(limit.daily)
+	r := loadRecord(u)
+	if n := r.active.Add(1); l != nil && l.conns != 0 && n > int64(l.conns) {
+		r.active.Add(-1)
+		return "too many connections", false
+	}
+	return "", true
+}
+
+// leave gives back a connection of u taken by enter.
+func leave(u user) {
+	if u.name != "" {
+		loadRecord(u).active.Add(-1)
+	}
+}
+
+// logOverCap logs that u is over a cap of l, at most once a minute.
+func logOverCap(remoteAddr string, u user, l *limit, reason string) {
+	metrics.overCap.Add(1)
+	l.st.Do(func() { accessLogger.Printf("%s[%s] %s", remoteAddr, u.name, reason) })
 }
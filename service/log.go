@@ -26,5 +26,6 @@ func initLogger() {
 		accessLogger.Debug("accesslog: " + *accesslog)
 		errorLogger.Debug("errorlog: " + *errorlog)
 	}
+	initJSONLogger(*jsonlog)
 	svc.Logger = accessLogger
 }
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/sunshineplan/service"
 	"github.com/sunshineplan/utils/flags"
@@ -13,15 +14,28 @@ import (
 
 // common flags
 var (
-	host      = flag.String("host", "", "Listening host")
-	port      = flag.String("port", "", "Listening port")
-	accesslog = flag.String("access-log", "", "Path to access log file")
-	errorlog  = flag.String("error-log", "", "Path to error log file")
-	secrets   = flag.String("secrets", "", "Path to secrets file for Basic Authentication")
-	whitelist = flag.String("whitelist", "", "Path to whitelist file")
-	status    = flag.String("status", "", "Path to status file")
-	keep      = flag.Int("keep", 100, "Count of status files")
-	debug     = flag.Bool("debug", false, "debug")
+	host        = flag.String("host", "", "Listening host")
+	port        = flag.String("port", "", "Listening port")
+	accesslog   = flag.String("access-log", "", "Path to access log file")
+	errorlog    = flag.String("error-log", "", "Path to error log file")
+	jsonlog     = flag.String("json-log", "", "Path to JSON access log file")
+	secrets     = flag.String("secrets", "", "Path to secrets file for Basic Authentication")
+	whitelist   = flag.String("whitelist", "", "Path to whitelist file")
+	status      = flag.String("status", "", "Path to status file")
+	digest      = flag.Bool("digest", false, "Offer Digest Authentication")
+	admin       = flag.String("admin", "", "Admin API listening port")
+	token       = flag.String("admin-token", "", "Bearer token for admin API")
+	metricsPort = flag.String("metrics", "", "Prometheus metrics listening port")
+	socksPort   = flag.String("socks", "", "SOCKS5 listening port")
+	keep        = flag.Int("keep", 100, "Count of status files")
+	dns         = flag.String("dns", "", "DNS upstreams for direct connections")
+	hostsFile   = flag.String("hosts", "", "Path to hosts file")
+	bandwidth   = flag.String("bandwidth", "", "Total bandwidth to clients")
+	listenerBW  = flag.String("listener-bandwidth", "", "Bandwidth to clients of each listener")
+	webhook     = flag.String("webhook", "", "Webhook URL of quota warnings")
+	hookScript  = flag.String("webhook-script", "", "Script run on quota warnings")
+	warnings    = flag.String("quota-warnings", "80,100", "Thresholds of quota warnings")
+	debug       = flag.Bool("debug", false, "debug")
 )
 
 const commonFlag = `
@@ -30,18 +44,44 @@ common:
     	Listening host
   --port <number>
     	Listening port
+  --socks <number>
+    	SOCKS5 listening port, through the auto proxy rules in client mode if enabled
   --access-log <file>
     	Path to access log file
   --error-log <file>
     	Path to error log file
+  --json-log <file>
+    	Path to JSON access log file
   --secrets <file>
     	Path to secrets file for Basic Authentication
   --whitelist <file>
     	Path to whitelist file
   --status <file>
     	Path to status file
+  --digest
+    	Offer Digest Authentication
+  --admin <number>
+    	Admin API listening port
+  --admin-token <string>
+    	Bearer token for admin API
+  --metrics <number>
+    	Prometheus metrics listening port
   --keep number
     	Count of status files (default: 100)
+  --dns <string>
+    	DNS upstreams for direct connections, separated by commas: https:// (DoH), tls:// (DoT) or udp:// (default: system resolver)
+  --hosts <file>
+    	Path to hosts file overriding DNS for direct connections
+  --bandwidth <size>
+    	Total bandwidth sent to clients, shared fairly by users (default: unlimited)
+  --listener-bandwidth <string>
+    	Bandwidth sent to clients of each listener, as name=size separated by commas: main, autoproxy, socks or transparent
+  --webhook <url>
+    	Webhook URL receiving quota warnings as JSON POST requests
+  --webhook-script <file>
+    	Script run on quota warnings, with the warning as JSON on stdin and in HTTPPROXY_* environment variables
+  --quota-warnings <string>
+    	Thresholds of quota warnings in percent of the quotas, separated by commas (default: 80,100)
   --update <url>
     	Update URL
 `
@@ -51,6 +91,8 @@ var (
 	https   = flag.Bool("https", false, "Serve as HTTPS proxy server")
 	cert    = flag.String("cert", "", "Path to certificate file")
 	privkey = flag.String("privkey", "", "Path to private key file")
+	aclFile = flag.String("acl", "", "Path to destination ACL file")
+	ports   = flag.String("connect-ports", "443", "Ports allowed for CONNECT")
 )
 
 const serverFlag = `
@@ -61,29 +103,73 @@ server side:
     	Path to certificate file
   --privkey <file>
     	Path to private key file
+  --acl <file>
+    	Path to destination ACL file
+  --connect-ports <string>
+    	Ports allowed for CONNECT without an ACL rule, as comma-separated ports and ranges, * for all (default: 443)
 `
 
 // client flags
 var (
-	proxyAddr = flag.String("proxy", "", "Proxy address")
-	username  = flag.String("username", "", "Username")
-	password  = flag.String("password", "", "Password")
-	autoproxy = flag.String("autoproxy", "", "Auto proxy listening port")
-	custom    = flag.String("custom", "", "Path to custom autoproxy file")
+	proxyAddr        = flag.String("proxy", "", "Proxy address")
+	balance          = flag.String("balance", "round-robin", "Balancing strategy of proxies")
+	healthCheck      = flag.String("health-check", "", "Target address of proxy health checks")
+	healthInterval   = flag.Duration("health-interval", 30*time.Second, "Interval of proxy health checks")
+	username         = flag.String("username", "", "Username")
+	password         = flag.String("password", "", "Password")
+	scheme           = flag.String("auth", "basic", "Authentication scheme for proxy")
+	autoproxy        = flag.String("autoproxy", "", "Auto proxy listening port")
+	autoproxySource  = flag.String("autoproxy-source", "", "Autoproxy rule sources")
+	autoproxyAttrs   = flag.String("autoproxy-attrs", "@-cn", "Attribute filter of autoproxy list")
+	autoproxyRefresh = flag.Duration("autoproxy-interval", 24*time.Hour, "Default refresh interval of autoproxy sources")
+	cacheDir         = flag.String("autoproxy-cache", "", "Directory of autoproxy cache")
+	outbound         = flag.String("outbound", "", "Named outbounds for autoproxy sources")
+	custom           = flag.String("custom", "", "Path to custom autoproxy file")
+	sniff            = flag.Bool("sniff", false, "Route CONNECT requests to addresses by the sniffed server name")
+	transparentPort  = flag.String("transparent", "", "Transparent proxy listening port")
+	tproxy           = flag.Bool("tproxy", false, "Accept TPROXY instead of REDIRECT connections on the transparent port")
 )
 
 const clientFlag = `
 client side:
   --proxy <string>
-    	Proxy address
+    	Proxy address, multiple proxies are separated by commas
+  --balance <string>
+    	Balancing strategy of proxies: round-robin, least-conn or latency (default: round-robin)
+  --health-check <host:port>
+    	Target address probed with CONNECT through every proxy, unhealthy proxies are taken out of rotation
+  --health-interval <duration>
+    	Interval of proxy health checks (default: 30s)
   --username <string>
     	Username for Basic Authentication
   --password <string>
     	Password for Basic Authentication
+  --auth <string>
+    	Authentication scheme for proxy: basic, digest or bearer (password as token) (default: basic)
   --autoproxy <string>
     	Auto proxy listening port
+  --autoproxy-attrs <string>
+    	Attributes selecting autoproxy list entries to proxy, @attr requires and @-attr excludes (default: @-cn)
+  --autoproxy-source <string>
+    	Autoproxy rule sources (URLs or files), separated by commas (default: v2fly geolocation-!cn list)
+  --outbound <string>
+    	Named outbounds for autoproxy sources, as name=proxy[,proxy...] separated by semicolons
+  --autoproxy-interval <duration>
+    	Default refresh interval of autoproxy sources (default: 24h)
+  --autoproxy-cache <dir>
+    	Directory where fetched autoproxy lists are cached (default: autoproxy-cache beside the executable)
+  --sniff
+    	Route CONNECT requests to IP addresses on ports 80 and 443 by the TLS server name or HTTP Host header of the tunnel
+  --transparent <number>
+    	Transparent proxy listening port for connections redirected by iptables/nftables (Linux only)
+  --tproxy
+    	Accept connections of TPROXY rules instead of REDIRECT on the transparent port
 `
 
+// configFile is the config file of flags, read again for the bandwidth on
+// SIGHUP.
+var configFile string
+
 var svc = service.New()
 
 func init() {
@@ -91,6 +177,7 @@ func init() {
 	svc.Desc = "HTTP(S) Proxy Server"
 	svc.Exec = run
 	svc.TestExec = test
+	svc.RegisterCommand("hash", "Generate secrets line with hashed password: hash <username> [algorithm]", hashCommand, -1, true)
 	svc.Options = service.Options{
 		Dependencies: []string{"After=network.target"},
 		Others:       []string{"ExecReload=kill -HUP $MAINPID"},
@@ -103,13 +190,14 @@ func main() {
 		log.Fatalln("Failed to get self path:", err)
 	}
 	recordFile = filepath.Join(filepath.Dir(self), "database")
+	configFile = filepath.Join(filepath.Dir(self), "config.ini")
 
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), `Usage of %s:%s%s%s%s`, os.Args[0], commonFlag, serverFlag, clientFlag, svc.Usage())
 	}
 	flag.StringVar(&svc.DebugAddr, "pprof", "", "pprof port")
 	flag.StringVar(&svc.Options.UpdateURL, "update", "", "Update URL")
-	flags.SetConfigFile(filepath.Join(filepath.Dir(self), "config.ini"))
+	flags.SetConfigFile(configFile)
 	flags.Parse()
 
 	if *secrets == "" {
@@ -124,6 +212,9 @@ func main() {
 	if *custom == "" {
 		*custom = filepath.Join(filepath.Dir(self), "autoproxy.txt")
 	}
+	if *cacheDir == "" {
+		*cacheDir = filepath.Join(filepath.Dir(self), "autoproxy-cache")
+	}
 
 	initLogger()
 
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sunshineplan/utils/container"
+	"github.com/sunshineplan/utils/counter"
+	"github.com/sunshineplan/utils/httpsvr"
+	"github.com/sunshineplan/utils/unit"
+)
+
+// counterVec is a set of counters partitioned by a single label value.
+type counterVec struct {
+	*container.Map[string, *counter.Counter]
+}
+
+func newCounterVec() counterVec {
+	return counterVec{container.NewMap[string, *counter.Counter]()}
+}
+
+func (v counterVec) with(label string) *counter.Counter {
+	c, _ := v.LoadOrStore(label, new(counter.Counter))
+	return c
+}
+
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 15}
+
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+var metrics = struct {
+	requests      counterVec
+	tunnels       counterVec
+	authRequired  counter.Counter
+	authFailed    counter.Counter
+	limitExceeded counter.Counter
+	notAllowed    counter.Counter
+	denied        counter.Counter
+	overCap       counter.Counter
+	dial          *container.Map[string, *histogram]
+}{
+	requests: newCounterVec(),
+	tunnels:  newCounterVec(),
+	dial:     container.NewMap[string, *histogram](),
+}
+
+// observeDial records the latency of a dial started at start.
+func observeDial(t DialerType, start time.Time) {
+	label := t.String()
+	if label == "" {
+		label = UseProxy.String()
+	}
+	h, _ := metrics.dial.LoadOrStore(label, new(histogram))
+	h.observe(time.Since(start).Seconds())
+}
+
+func requestKind(r *http.Request) string {
+	switch {
+	case isConnectUDP(r):
+		return "udp"
+	case r.Method == http.MethodConnect:
+		return "connect"
+	default:
+		return "http"
+	}
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func writeCounterVec(w io.Writer, name, help, typ, label string, v counterVec) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	var keys []string
+	v.Range(func(k string, _ *counter.Counter) bool {
+		keys = append(keys, k)
+		return true
+	})
+	slices.Sort(keys)
+	for _, k := range keys {
+		c, _ := v.Load(k)
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, escapeLabel(k), c.Get())
+	}
+}
+
+func writeCounter(w io.Writer, name, help string, c *counter.Counter) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, c.Get())
+}
+
+func writeMetrics(base *Base, w io.Writer) {
+	fmt.Fprintln(w, "# HELP httpproxy_traffic_bytes Traffic of users and whitelist records by direction and period.")
+	fmt.Fprintln(w, "# TYPE httpproxy_traffic_bytes gauge")
+	var res []*usage
+	recordMap.Range(func(u user, _ *record) bool {
+		if usage := getUsage(u); usage != nil {
+			res = append(res, usage)
+		}
+		return true
+	})
+	slices.SortFunc(res, func(a, b *usage) int { return strings.Compare(a.user.name, b.user.name) })
+	for _, i := range res {
+		typ := "account"
+		if i.user.whitelist {
+			typ = "whitelist"
+		}
+		for _, d := range []struct {
+			direction string
+			traffic
+		}{{"download", i.download}, {"upload", i.upload}} {
+			for _, p := range []struct {
+				period string
+				value  unit.ByteSize
+			}{{"today", d.today}, {"weekly", d.weekly}, {"monthly", d.monthly}, {"total", d.total}} {
+				fmt.Fprintf(w, "httpproxy_traffic_bytes{user=\"%s\",type=\"%s\",direction=\"%s\",period=\"%s\"} %d\n",
+					escapeLabel(i.user.name), typ, d.direction, p.period, p.value)
+			}
+		}
+		usagePool.Put(i)
+	}
+
+	writeCounterVec(w, "httpproxy_requests_total", "Proxy requests by kind.", "counter", "kind", metrics.requests)
+	writeCounterVec(w, "httpproxy_active_tunnels", "Active tunnels by protocol.", "gauge", "protocol", metrics.tunnels)
+	writeCounter(w, "httpproxy_auth_required_total", "Responses of 407 Proxy Authentication Required.", &metrics.authRequired)
+	writeCounter(w, "httpproxy_auth_failures_total", "Failed proxy authentications.", &metrics.authFailed)
+	writeCounter(w, "httpproxy_limit_exceeded_total", "Requests rejected for exceeded traffic limit.", &metrics.limitExceeded)
+	writeCounter(w, "httpproxy_not_allowed_total", "Requests rejected for not allowed address.", &metrics.notAllowed)
+	writeCounter(w, "httpproxy_denied_total", "Requests rejected by the destination ACL.", &metrics.denied)
+	writeCounter(w, "httpproxy_over_cap_total", "Requests rejected for too many connections or requests.", &metrics.overCap)
+
+	fmt.Fprintln(w, "# HELP httpproxy_dial_duration_seconds Latency of dialing destinations by dialer type.")
+	fmt.Fprintln(w, "# TYPE httpproxy_dial_duration_seconds histogram")
+	var keys []string
+	metrics.dial.Range(func(k string, _ *histogram) bool {
+		keys = append(keys, k)
+		return true
+	})
+	slices.Sort(keys)
+	for _, k := range keys {
+		h, _ := metrics.dial.Load(k)
+		h.mu.Lock()
+		for i, le := range append(latencyBuckets, math.Inf(1)) {
+			count := h.count
+			if i < len(h.counts) {
+				count = h.counts[i]
+			}
+			fmt.Fprintf(w, "httpproxy_dial_duration_seconds_bucket{dialer=\"%s\",le=\"%s\"} %d\n", k, formatFloat(le), count)
+		}
+		fmt.Fprintf(w, "httpproxy_dial_duration_seconds_sum{dialer=\"%s\"} %s\n", k, formatFloat(h.sum))
+		fmt.Fprintf(w, "httpproxy_dial_duration_seconds_count{dialer=\"%s\"} %d\n", k, h.count)
+		h.mu.Unlock()
+	}
+}
+
+func NewMetrics(base *Base, port string) *httpsvr.Server {
+	server := httpsvr.New()
+	server.Host = base.Host
+	server.Port = port
+	server.ErrorLog = errorLogger.Logger
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(base, w)
+	})
+	server.Handler = mux
+	return server
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"io"
+	"io/fs"
 	"net"
+	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
-	"github.com/sunshineplan/limiter"
+	"github.com/sunshineplan/httpproxy/masque"
 	"golang.org/x/time/rate"
 )
 
@@ -59,14 +64,136 @@ func watchFile(file string, fnChange, fnRemove func()) error {
 	return nil
 }
 
-func transfer(dst, src net.Conn, user user, lim *limiter.Limiter) {
-	defer dst.Close()
-	defer src.Close()
+// writeFile writes data to file atomically through a temporary file in the
+// same directory, synced to disk, keeping the permissions of an existing
+// file.
+func writeFile(file string, data []byte) error {
+	perm := fs.FileMode(0600)
+	if info, err := os.Stat(file); err == nil {
+		perm = info.Mode().Perm()
+	}
+	f, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), file); err != nil {
+		return err
+	}
+	// make the rename durable, where directories can be synced
+	if d, err := os.Open(filepath.Dir(file)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// pipe copies data between the client and dest in both directions until
+// either side closes. Data sent to the client is shaped by lim.
+func pipe(client, dest net.Conn, u user, lim *flow) {
+	metrics.tunnels.with("tcp").Add(1)
+	defer metrics.tunnels.with("tcp").Add(-1)
+	go transfer(dest, client, countUpload(u, dest))
 	if lim == nil {
-		io.Copy(count(user, dst), src)
+		transfer(client, dest, count(u, client))
 	} else {
-		io.Copy(count(user, lim.Writer(dst)), src)
+		transfer(client, dest, count(u, lim.Writer(client)))
+	}
+}
+
+// transfer copies src to w, which writes to dst, and closes both
+// connections once done.
+func transfer(dst, src net.Conn, w io.Writer) {
+	defer dst.Close()
+	defer src.Close()
+	io.Copy(w, src)
+}
+
+// tunnel serves a CONNECT request received over HTTP/2, whose stream
+// can not be hijacked, until either side closes.
+func tunnel(dest net.Conn, w http.ResponseWriter, r *http.Request, user user, lim *flow) {
+	defer dest.Close()
+	metrics.tunnels.with("tcp").Add(1)
+	defer metrics.tunnels.with("tcp").Add(-1)
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	go func() {
+		defer dest.Close()
+		io.Copy(countUpload(user, dest), r.Body)
+	}()
+	io.Copy(count(user, lim.Writer(flushWriter{w, rc})), dest)
+}
+
+// relay forwards HTTP Datagrams read from r to the UDP socket dest and the
+// packets received on dest back to w until either side fails.
+func relay(dest net.Conn, r *bufio.Reader, w io.Writer, user user, lim *flow) {
+	defer dest.Close()
+	metrics.tunnels.with("udp").Add(1)
+	defer metrics.tunnels.with("udp").Add(-1)
+	go func() {
+		defer dest.Close()
+		up := countUpload(user, dest)
+		for {
+			b, err := masque.ReadDatagram(r)
+			if err != nil {
+				return
+			}
+			up.Write(b)
+		}
+	}()
+	w = count(user, lim.Writer(w))
+	b := make([]byte, 64*1024)
+	for {
+		n, err := dest.Read(b)
+		if err != nil {
+			return
+		}
+		if err := masque.WriteDatagram(w, b[:n]); err != nil {
+			return
+		}
+	}
+}
+
+type flushWriter struct {
+	io.Writer
+	rc *http.ResponseController
+}
+
+func (w flushWriter) Write(b []byte) (n int, err error) {
+	if n, err = w.Writer.Write(b); err != nil {
+		return
+	}
+	err = w.rc.Flush()
+	return
+}
+
+// parseProxies parses a comma-separated list of proxy addresses.
+func parseProxies(s string) (res []*url.URL) {
+	for s := range strings.SplitSeq(s, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			res = append(res, parseProxy(s))
+		}
 	}
+	return
 }
 
 func parseProxy(s string) *url.URL {
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sunshineplan/httpproxy/auth"
+	"github.com/sunshineplan/utils/unit"
+)
+
+const (
+	webhookTimeout = 10 * time.Second
+	webhookRetries = 3
+	scriptTimeout  = 30 * time.Second
+)
+
+// webhookBackoff is the wait before the first retry of a webhook, doubled
+// for each retry after.
+var webhookBackoff = 5 * time.Second
+
+// quotaWindows names the windows of the daily, weekly and monthly quotas.
+var quotaWindows = [3]string{"daily", "weekly", "monthly"}
+
+// quotaWarnings are the thresholds of limits without their own, in percent
+// of the quotas.
+var quotaWarnings = []int{80, 100}
+
+var notifier *Notifier
+
+// parseThresholds parses percentages separated by sep.
+func parseThresholds(s, sep string) ([]int, error) {
+	var thresholds []int
+	for i := range strings.SplitSeq(s, sep) {
+		if i = strings.TrimSuffix(strings.TrimSpace(i), "%"); i == "" {
+			continue
+		}
+		n, err := strconv.Atoi(i)
+		if err != nil || n <= 0 {
+			return nil, errors.New("bad threshold: " + i)
+		}
+		thresholds = append(thresholds, n)
+	}
+	slices.Sort(thresholds)
+	return slices.Compact(thresholds), nil
+}
+
+// quotaEvent is the payload of a quota warning.
+type quotaEvent struct {
+	User      string    `json:"user"`
+	Whitelist bool      `json:"whitelist"`
+	Window    string    `json:"window"`
+	Quota     string    `json:"quota"`
+	Threshold int       `json:"threshold"`
+	Used      int64     `json:"used"`
+	Limit     int64     `json:"limit"`
+	Time      time.Time `json:"time"`
+}
+
+// Notifier sends quota warnings to a webhook, as JSON POST requests, and
+// to a script, which gets the event as JSON on stdin and in HTTPPROXY_*
+// environment variables.
+type Notifier struct {
+	url    string
+	script string
+	client *http.Client
+}
+
+func NewNotifier(url, script string) *Notifier {
+	return &Notifier{url: url, script: script, client: &http.Client{Timeout: webhookTimeout}}
+}
+
+// check sends a warning for each window of l in which the usage of u has
+// crossed a threshold higher than it had been warned of.
+func (n *Notifier) check(u user, l *limit, r *record) {
+	thresholds := l.warn
+	if thresholds == nil {
+		thresholds = quotaWarnings
+	}
+	today, weekly, monthly := l.quota.usage(r, l.window)
+	used := [3]int64{today, weekly, monthly}
+	limits := [3]unit.ByteSize{l.daily, l.weekly, l.monthly}
+	var events []quotaEvent
+	r.mu.Lock()
+	for i, limit := range limits {
+		var level int
+		if limit != 0 {
+			for _, t := range thresholds {
+				if used[i]*100 >= int64(limit)*int64(t) {
+					level = t
+				}
+			}
+		}
+		if level > r.warned[i] {
+			events = append(events, quotaEvent{
+				u.name, u.whitelist, quotaWindows[i], l.quota.String(), level, used[i], int64(limit), time.Now(),
+			})
+		}
+		// usage falls only in a new window, or out of a rolling one
+		r.warned[i] = level
+	}
+	r.mu.Unlock()
+	for _, e := range events {
+		accessLogger.Printf("[%s] %d%% of %s quota used", e.User, e.Threshold, e.Window)
+		go n.notify(e)
+	}
+}
+
+func (n *Notifier) notify(e quotaEvent) {
+	b, _ := json.Marshal(e)
+	if n.url != "" {
+		if err := n.post(b); err != nil {
+			errorLogger.Println("failed to send quota warning:", err)
+		}
+	}
+	if n.script != "" {
+		if err := n.run(e, b); err != nil {
+			errorLogger.Println("failed to run quota warning script:", err)
+		}
+	}
+}
+
+// post sends b to the webhook, retrying on errors and responses other
+// than 2xx.
+func (n *Notifier) post(b []byte) (err error) {
+	backoff := webhookBackoff
+	for i := range webhookRetries + 1 {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var resp *http.Response
+		if resp, err = n.client.Post(n.url, "application/json", bytes.NewReader(b)); err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 == 2 {
+			return nil
+		}
+		err = errors.New("webhook responded " + resp.Status)
+	}
+	return
+}
+
+func (n *Notifier) run(e quotaEvent, b []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), scriptTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, n.script)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Env = append(os.Environ(),
+		"HTTPPROXY_USER="+e.User,
+		"HTTPPROXY_WHITELIST="+strconv.FormatBool(e.Whitelist),
+		"HTTPPROXY_WINDOW="+e.Window,
+		"HTTPPROXY_QUOTA="+e.Quota,
+		"HTTPPROXY_THRESHOLD="+strconv.Itoa(e.Threshold),
+		"HTTPPROXY_USED="+strconv.FormatInt(e.Used, 10),
+		"HTTPPROXY_LIMIT="+strconv.FormatInt(e.Limit, 10),
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return errors.New(err.Error() + ": " + strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// checkQuotas sends the quota warnings of the records of base.
+func checkQuotas(base *Base) {
+	if notifier == nil {
+		return
+	}
+	base.accounts.Range(func(a auth.Basic, l *limit) bool {
+		if v, ok := recordMap.Load(user{a.Username, false}); ok && l.hasQuota() {
+			notifier.check(user{a.Username, false}, l, v)
+		}
+		return true
+	})
+	base.whitelist.Range(func(a allow, l *limit) bool {
+		if v, ok := recordMap.Load(user{string(a), true}); ok && l.hasQuota() {
+			notifier.check(user{string(a), true}, l, v)
+		}
+		return true
+	})
+}
+
+func initNotifier(url, script, warnings string) (err error) {
+	if quotaWarnings, err = parseThresholds(warnings, ","); err != nil {
+		return
+	}
+	if url != "" || script != "" {
+		notifier = NewNotifier(url, script)
+	}
+	return
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+)
+
+var errRejected = errors.New("rejected by autoproxy rules")
+
+// reject is the outbound refusing every connection.
+type reject struct{}
+
+func (reject) Dial(_, _ string) (net.Conn, error) { return nil, errRejected }
+
+// isBuiltinOutbound reports whether t is an outbound every client has.
+func isBuiltinOutbound(t DialerType) bool {
+	return t == UseDirect || t == UseProxy || t == UseReject
+}
+
+// parseOutbounds parses named outbounds separated by semicolons, each as
+// a name and its comma-separated proxies:
+//
+//	streaming=socks5://10.0.0.2:1080; work=http://10.0.0.3:8080,http://10.0.0.4:8080
+func parseOutbounds(s string) (map[DialerType][]*url.URL, error) {
+	outbounds := make(map[DialerType][]*url.URL)
+	for i := range strings.SplitSeq(s, ";") {
+		if strings.TrimSpace(i) == "" {
+			continue
+		}
+		name, proxies, ok := strings.Cut(i, "=")
+		if !ok {
+			return nil, errors.New("bad outbound: " + i)
+		}
+		t := DialerType(strings.ToLower(strings.TrimSpace(name)))
+		if t == "" || strings.ContainsAny(string(t), " []") {
+			return nil, errors.New("bad outbound name: " + name)
+		}
+		if isBuiltinOutbound(t) {
+			return nil, errors.New("reserved outbound name: " + name)
+		}
+		if _, ok := outbounds[t]; ok {
+			return nil, errors.New("duplicate outbound: " + name)
+		}
+		for p := range strings.SplitSeq(proxies, ",") {
+			if p = strings.TrimSpace(p); p == "" {
+				continue
+			}
+			u, err := url.Parse(p)
+			if err != nil {
+				return nil, err
+			}
+			outbounds[t] = append(outbounds[t], u)
+		}
+		if len(outbounds[t]) == 0 {
+			return nil, errors.New("no proxy for outbound: " + name)
+		}
+	}
+	return outbounds, nil
+}
+
+// checkOutbounds returns an error if a source routes to an unknown outbound.
+func checkOutbounds(sources []*source, outbounds map[DialerType][]*url.URL) error {
+	for _, s := range sources {
+		if _, ok := outbounds[s.outbound]; !ok && !isBuiltinOutbound(s.outbound) {
+			return errors.New("unknown outbound of autoproxy source " + s.location + ": " + string(s.outbound))
+		}
+	}
+	return nil
+}
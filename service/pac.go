@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+const pacScript = `var rules = %s;
+var hasIP = %t;
+
+function compile(rule) {
+  var list = rule.regexps;
+  rule.regexps = [];
+  for (var i = 0; i < list.length; i++) {
+    try {
+      rule.regexps.push(new RegExp(list[i]));
+    } catch (e) {}
+  }
+  if (rule.except) {
+    compile(rule.except);
+  }
+}
+
+for (var i = 0; i < rules.length; i++) {
+  compile(rules[i]);
+}
+
+function match(rule, host) {
+  if (rule.hosts.hasOwnProperty(host)) {
+    return true;
+  }
+  if (/^\d+\.\d+\.\d+\.\d+$/.test(host)) {
+    for (var i = 0; i < rule.networks.length; i++) {
+      if (isInNet(host, rule.networks[i][0], rule.networks[i][1])) {
+        return true;
+      }
+    }
+    return false;
+  }
+  for (var s = host; ; s = s.substring(s.indexOf(".") + 1)) {
+    if (rule.zones.hasOwnProperty(s)) {
+      return true;
+    }
+    if (s.indexOf(".") == -1) {
+      break;
+    }
+  }
+  for (var i = 0; i < rule.keywords.length; i++) {
+    if (host.indexOf(rule.keywords[i]) != -1) {
+      return true;
+    }
+  }
+  for (var i = 0; i < rule.regexps.length; i++) {
+    if (rule.regexps[i].test(host)) {
+      return true;
+    }
+  }
+  return false;
+}
+
+function route(host, ip) {
+  for (var i = 0; i < rules.length; i++) {
+    if (ip && !rules[i].ip) {
+      continue;
+    }
+    if (match(rules[i], host) && !(rules[i].except && match(rules[i].except, host))) {
+      return rules[i].action;
+    }
+  }
+  return null;
+}
+
+function FindProxyForURL(url, host) {
+  host = host.toLowerCase();
+  var action = route(host, false);
+  if (action) {
+    return action;
+  }
+  if (!/^\d+\.\d+\.\d+\.\d+$/.test(host) && hasIP) {
+    var ip = dnsResolve(host);
+    if (ip && (action = route(ip, true))) {
+      return action;
+    }
+  }
+  return "DIRECT";
+}
+`
+
+// pacRule is a route in the proxy auto-config file.
+type pacRule struct {
+	Action   string         `json:"action,omitempty"`
+	Zones    map[string]int `json:"zones"`
+	Hosts    map[string]int `json:"hosts"`
+	Networks [][2]string    `json:"networks"`
+	Keywords []string       `json:"keywords"`
+	Regexps  []string       `json:"regexps"`
+	Except   *pacRule       `json:"except,omitempty"`
+	IP       bool           `json:"ip,omitempty"`
+}
+
+func newPACRule(r *rules) *pacRule {
+	rule := &pacRule{
+		Zones:    make(map[string]int),
+		Hosts:    make(map[string]int),
+		Networks: [][2]string{},
+		Keywords: append([]string{}, r.keywords...),
+		Regexps:  []string{},
+	}
+	for zone := range r.zones {
+		rule.Zones[zone] = 1
+	}
+	for host := range r.hosts {
+		rule.Hosts[host] = 1
+	}
+	for _, ip := range r.ips {
+		rule.Hosts[ip.String()] = 1
+	}
+	for _, network := range r.networks {
+		if ip := network.IP.To4(); ip != nil && len(network.Mask) == net.IPv4len {
+			rule.Networks = append(rule.Networks, [2]string{ip.String(), net.IP(network.Mask).String()})
+		}
+	}
+	for _, re := range r.regexps {
+		rule.Regexps = append(rule.Regexps, re.String())
+	}
+	rule.IP = len(r.ips) != 0 || len(rule.Networks) != 0
+	return rule
+}
+
+// writePAC writes a proxy auto-config file which makes the same choices
+// as routes, except for rules on countries of a MaxMind DB. Destinations
+// of the proxy go to the proxy listener at address, those of other
+// outbounds to the autoproxy listener at autoproxy, which rejects or
+// dials them itself.
+func writePAC(w io.Writer, address, autoproxy string, routes []route) error {
+	rules := []*pacRule{}
+	var hasIP bool
+	for _, route := range routes {
+		rule := newPACRule(route.rules)
+		switch route.outbound {
+		case UseDirect:
+			rule.Action = "DIRECT"
+		case UseProxy:
+			rule.Action = "PROXY " + address
+		default:
+			rule.Action = "PROXY " + autoproxy
+		}
+		if route.except != nil {
+			rule.Except = newPACRule(route.except)
+		}
+		rule.IP = rule.IP && !route.noResolve
+		hasIP = hasIP || rule.IP
+		rules = append(rules, rule)
+	}
+	b, _ := json.Marshal(rules)
+	_, err := fmt.Fprintf(w, pacScript, b, hasIP)
+	return err
+}
+
+// isPAC reports whether r requests the proxy auto-config file from the
+// listener rather than through the proxy.
+func isPAC(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.URL.Host == "" && r.URL.Path == "/proxy.pac"
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// verified caches successful verifications of hashed passwords, so that
+// a slow hash is computed once rather than for every request. It is
+// cleared when the secrets are reloaded.
+var verified sync.Map
+
+func isHashed(secret string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$argon2id$", "$5$", "$6$"} {
+		if strings.HasPrefix(secret, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyPassword reports whether password matches the stored secret, which
+// is either plaintext or a bcrypt, argon2id or SHA-crypt hash.
+func verifyPassword(secret, password string) bool {
+	if !isHashed(secret) {
+		return subtle.ConstantTimeCompare([]byte(secret), []byte(password)) == 1
+	}
+	key := sha256.Sum256([]byte(secret + "\x00" + password))
+	if _, ok := verified.Load(key); ok {
+		return true
+	}
+	var ok bool
+	switch {
+	case strings.HasPrefix(secret, "$argon2id$"):
+		ok = verifyArgon2id(secret, password)
+	case strings.HasPrefix(secret, "$5$"), strings.HasPrefix(secret, "$6$"):
+		ok = verifySHACrypt(secret, password)
+	default:
+		ok = bcrypt.CompareHashAndPassword([]byte(secret), []byte(password)) == nil
+	}
+	if ok {
+		verified.Store(key, struct{}{})
+	}
+	return ok
+}
+
+func hashPassword(algorithm, password string) (string, error) {
+	switch strings.ToLower(algorithm) {
+	case "", "bcrypt":
+		b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(b), err
+	case "argon2id":
+		salt := make([]byte, 16)
+		rand.Read(salt)
+		return encodeArgon2id(password, salt, 19, 64*1024, 3, 4, 32), nil
+	case "sha256-crypt":
+		return shaCrypt(sha256.New, "$5$", password, rand.Text()[:16], 0), nil
+	case "sha512-crypt":
+		return shaCrypt(sha512.New, "$6$", password, rand.Text()[:16], 0), nil
+	default:
+		return "", errors.New("unsupported algorithm: " + algorithm)
+	}
+}
+
+func hashCommand(arg ...string) error {
+	if len(arg) == 0 || len(arg) > 2 {
+		return errors.New("usage: hash <username> [bcrypt|argon2id|sha256-crypt|sha512-crypt]")
+	}
+	if strings.Contains(arg[0], ":") {
+		return errors.New("username can not contain colon")
+	}
+	var algorithm string
+	if len(arg) == 2 {
+		algorithm = arg[1]
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if password = strings.TrimRight(password, "\r\n"); password == "" {
+		if err != nil {
+			return err
+		}
+		return errors.New("empty password")
+	}
+	secret, err := hashPassword(algorithm, password)
+	if err != nil {
+		return err
+	}
+	fmt.Println(arg[0] + ":" + secret)
+	return nil
+}
+
+func encodeArgon2id(password string, salt []byte, version int, memory, time uint32, threads uint8, keyLen uint32) string {
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, keyLen)
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		version, memory, time, threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+	)
+}
+
+func verifyArgon2id(secret, password string) bool {
+	s := strings.Split(secret, "$")
+	if len(s) != 6 {
+		return false
+	}
+	var version int
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(s[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(s[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(s[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(s[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare(
+		[]byte(encodeArgon2id(password, salt, version, memory, time, threads, uint32(len(key)))),
+		[]byte(secret),
+	) == 1
+}
+
+func verifySHACrypt(secret, password string) bool {
+	s := strings.Split(secret, "$")
+	var rounds int
+	var salt string
+	switch len(s) {
+	case 4:
+		salt = s[2]
+	case 5:
+		r, ok := strings.CutPrefix(s[2], "rounds=")
+		if !ok {
+			return false
+		}
+		var err error
+		if rounds, err = strconv.Atoi(r); err != nil {
+			return false
+		}
+		salt = s[3]
+	default:
+		return false
+	}
+	var expected string
+	if s[1] == "5" {
+		expected = shaCrypt(sha256.New, "$5$", password, salt, rounds)
+	} else {
+		expected = shaCrypt(sha512.New, "$6$", password, salt, rounds)
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(secret)) == 1
+}
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+var (
+	sha256Order = [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	}
+	sha512Order = [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+)
+
+func b64From24bit(b *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for range n {
+		b.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
+
+// shaCrypt implements the SHA-crypt password hashing scheme. Zero rounds
+// is the default of 5000, which is left out of the result as it is when
+// no rounds are given in a hash.
+func shaCrypt(newHash func() hash.Hash, magic, password, salt string, rounds int) string {
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	custom := rounds != 0
+	if !custom {
+		rounds = 5000
+	}
+	rounds = min(max(rounds, 1000), 999999999)
+	p, s := []byte(password), []byte(salt)
+
+	h := newHash()
+	h.Write(p)
+	h.Write(s)
+	h.Write(p)
+	b := h.Sum(nil)
+	size := len(b)
+
+	h.Reset()
+	h.Write(p)
+	h.Write(s)
+	for n := len(p); n > 0; n -= size {
+		h.Write(b[:min(n, size)])
+	}
+	for n := len(p); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(p)
+		}
+	}
+	a := h.Sum(nil)
+
+	h.Reset()
+	for range len(p) {
+		h.Write(p)
+	}
+	dp := h.Sum(nil)
+	pseq := make([]byte, 0, len(p))
+	for n := len(p); n > 0; n -= size {
+		pseq = append(pseq, dp[:min(n, size)]...)
+	}
+
+	h.Reset()
+	for range 16 + int(a[0]) {
+		h.Write(s)
+	}
+	ds := h.Sum(nil)
+	sseq := ds[:len(s)]
+
+	c := a
+	for i := range rounds {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(pseq)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(sseq)
+		}
+		if i%7 != 0 {
+			h.Write(pseq)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(pseq)
+		}
+		c = h.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(magic)
+	if custom {
+		fmt.Fprintf(&out, "rounds=%d$", rounds)
+	}
+	out.WriteString(salt + "$")
+	if size == sha256.Size {
+		for _, i := range sha256Order {
+			b64From24bit(&out, c[i[0]], c[i[1]], c[i[2]], 4)
+		}
+		b64From24bit(&out, 0, c[31], c[30], 3)
+	} else {
+		for _, i := range sha512Order {
+			b64From24bit(&out, c[i[0]], c[i[1]], c[i[2]], 4)
+		}
+		b64From24bit(&out, 0, 0, c[63], 2)
+	}
+	return out.String()
+}
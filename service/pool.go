@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sunshineplan/httpproxy"
+	"github.com/sunshineplan/httpproxy/auth"
+	"golang.org/x/net/proxy"
+)
+
+// Strategy chooses the upstream proxy for a new connection.
+type Strategy int
+
+const (
+	RoundRobin Strategy = iota
+	LeastConn
+	Latency
+)
+
+var strategyList = map[Strategy]string{
+	RoundRobin: "round-robin",
+	LeastConn:  "least-conn",
+	Latency:    "latency",
+}
+
+func (s Strategy) String() string {
+	return strategyList[s]
+}
+
+func parseStrategy(s string) (Strategy, error) {
+	for strategy, name := range strategyList {
+		if name == strings.ToLower(s) {
+			return strategy, nil
+		}
+	}
+	return 0, errors.New("unknown balancing strategy: " + s)
+}
+
+const probeTimeout = 10 * time.Second
+
+// upstream is a proxy server in the pool.
+type upstream struct {
+	u      *url.URL
+	dialer proxy.Dialer
+
+	down     atomic.Bool
+	active   atomic.Int64
+	latency  atomic.Int64 // moving average of dial latency in nanoseconds
+	failures atomic.Int64
+	lastErr  atomic.Pointer[string]
+}
+
+func newUpstream(u *url.URL) (*upstream, error) {
+	d, err := proxy.FromURL(u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &upstream{u: u, dialer: d}, nil
+}
+
+func (u *upstream) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	start := time.Now()
+	var conn net.Conn
+	var err error
+	if d, ok := u.dialer.(proxy.ContextDialer); ok {
+		conn, err = d.DialContext(ctx, network, address)
+	} else {
+		conn, err = u.dialer.Dial(network, address)
+	}
+	if err != nil {
+		if refused(err) {
+			return nil, err
+		}
+		u.failures.Add(1)
+		s := err.Error()
+		u.lastErr.Store(&s)
+		return nil, err
+	}
+	u.observe(time.Since(start))
+	return conn, nil
+}
+
+// refused reports whether err is a reply of a reachable proxy refusing
+// the request, which another upstream would most likely refuse too.
+func refused(err error) bool {
+	var status httpproxy.StatusError
+	return errors.As(err, &status)
+}
+
+func (u *upstream) observe(d time.Duration) {
+	for {
+		old := u.latency.Load()
+		n := int64(d)
+		if old != 0 {
+			n = (old*7 + n) / 8
+		}
+		if u.latency.CompareAndSwap(old, n) {
+			return
+		}
+	}
+}
+
+func (u *upstream) setProxyAuth(pa *proxy.Auth) {
+	if pa != nil {
+		u.u.User = url.UserPassword(pa.User, pa.Password)
+	} else {
+		u.u.User = nil
+	}
+	if d, ok := u.dialer.(*httpproxy.Dialer); ok {
+		if pa != nil {
+			d.Auth = auth.Basic{Username: pa.User, Password: pa.Password}
+		} else {
+			d.Auth = nil
+		}
+	} else if u.u.Scheme == "socks5" || u.u.Scheme == "socks5h" {
+		addr := u.u.Hostname()
+		port := u.u.Port()
+		if port == "" {
+			port = "1080"
+		}
+		u.dialer, _ = proxy.SOCKS5("tcp", net.JoinHostPort(addr, port), pa, nil)
+	}
+}
+
+// Pool dials through a set of upstream proxies. Upstreams failing the
+// health check are taken out of rotation until they pass again or a dial
+// through them succeeds, and a dial which fails to reach a proxy falls
+// over to the next upstream.
+type Pool struct {
+	upstreams []*upstream
+	strategy  Strategy
+	next      atomic.Uint64
+
+	target   string
+	interval time.Duration
+	stop     chan struct{}
+	once     sync.Once
+}
+
+var (
+	_ proxy.Dialer        = new(Pool)
+	_ proxy.ContextDialer = new(Pool)
+)
+
+func NewPool(urls ...*url.URL) (*Pool, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("no upstream proxy")
+	}
+	p := &Pool{stop: make(chan struct{})}
+	for _, u := range urls {
+		upstream, err := newUpstream(u)
+		if err != nil {
+			return nil, err
+		}
+		p.upstreams = append(p.upstreams, upstream)
+	}
+	return p, nil
+}
+
+// pick chooses an upstream not in tried. Upstreams that are down are
+// only chosen if no other is left.
+func (p *Pool) pick(tried map[*upstream]bool) *upstream {
+	var candidates, down []*upstream
+	for _, u := range p.upstreams {
+		if tried[u] {
+			continue
+		}
+		if u.down.Load() {
+			down = append(down, u)
+		} else {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = down
+	}
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+	switch p.strategy {
+	case LeastConn:
+		res := candidates[0]
+		for _, u := range candidates[1:] {
+			if u.active.Load() < res.active.Load() {
+				res = u
+			}
+		}
+		return res
+	case Latency:
+		weights := make([]float64, len(candidates))
+		var sum float64
+		for i, u := range candidates {
+			weights[i] = 1 / float64(max(u.latency.Load(), int64(time.Millisecond)))
+			sum += weights[i]
+		}
+		n := rand.Float64() * sum
+		for i, w := range weights {
+			if n < w {
+				return candidates[i]
+			}
+			n -= w
+		}
+		return candidates[len(candidates)-1]
+	default:
+		return candidates[p.next.Add(1)%uint64(len(candidates))]
+	}
+}
+
+func (p *Pool) Dial(network, address string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, address)
+}
+
+func (p *Pool) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	tried := make(map[*upstream]bool)
+	var err error
+	for u := p.pick(tried); u != nil; u = p.pick(tried) {
+		tried[u] = true
+		var conn net.Conn
+		if conn, err = u.dial(ctx, network, address); err == nil {
+			if u.down.Swap(false) {
+				accessLogger.Printf("upstream %s is up", u.u.Redacted())
+			}
+			u.active.Add(1)
+			return &poolConn{Conn: conn, u: u}, nil
+		}
+		if ctx.Err() != nil || refused(err) {
+			break
+		}
+		if len(p.upstreams) > 1 {
+			errorLogger.Printf("upstream %s: %s", u.u.Redacted(), err)
+		}
+	}
+	return nil, err
+}
+
+// url returns the URL of the first upstream in rotation.
+func (p *Pool) url() *url.URL {
+	for _, u := range p.upstreams {
+		if !u.down.Load() {
+			return u.u
+		}
+	}
+	return p.upstreams[0].u
+}
+
+// SetHealthCheck enables health checks which probe target with CONNECT
+// through every upstream at the given interval.
+func (p *Pool) SetHealthCheck(target string, interval time.Duration) *Pool {
+	p.target = target
+	p.interval = interval
+	return p
+}
+
+func (p *Pool) check() {
+	var wg sync.WaitGroup
+	for _, u := range p.upstreams {
+		wg.Go(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+			defer cancel()
+			conn, err := u.dial(ctx, "tcp", p.target)
+			if err != nil {
+				if !u.down.Swap(true) {
+					errorLogger.Printf("upstream %s is down: %s", u.u.Redacted(), err)
+				}
+				return
+			}
+			conn.Close()
+			if u.down.Swap(false) {
+				accessLogger.Printf("upstream %s is up", u.u.Redacted())
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// Start runs health checks until Stop is called. It does nothing if
+// health checks are not enabled.
+func (p *Pool) Start() {
+	if p.target == "" || p.interval <= 0 {
+		return
+	}
+	p.check()
+	go func() {
+		t := time.NewTicker(p.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-t.C:
+				p.check()
+			}
+		}
+	}()
+}
+
+func (p *Pool) Stop() {
+	p.once.Do(func() { close(p.stop) })
+}
+
+// WriteStatus writes the state of every upstream.
+func (p *Pool) WriteStatus(w io.Writer) {
+	fmt.Fprintf(w, "Upstreams (%s):\n", p.strategy)
+	for _, u := range p.upstreams {
+		state := "up"
+		if u.down.Load() {
+			state = "down"
+		}
+		fmt.Fprintf(w, "%s   %s   active: %d   latency: %s   failures: %d",
+			u.u.Redacted(), state, u.active.Load(),
+			time.Duration(u.latency.Load()).Round(time.Millisecond), u.failures.Load())
+		if err := u.lastErr.Load(); err != nil {
+			fmt.Fprintf(w, "   last error: %s", *err)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// poolConn is a connection through an upstream, counted as active until
+// it is closed.
+type poolConn struct {
+	net.Conn
+	u    *upstream
+	once sync.Once
+}
+
+func (c *poolConn) Close() error {
+	c.once.Do(func() { c.u.active.Add(-1) })
+	return c.Conn.Close()
+}
@@ -1,19 +1,21 @@
 package main
 
 import (
-	"compress/gzip"
-	"fmt"
+	"errors"
 	"io"
-	"os"
+	"io/fs"
+	"math"
+	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sunshineplan/httpproxy/auth"
 	"github.com/sunshineplan/utils/container"
 	"github.com/sunshineplan/utils/counter"
 	"github.com/sunshineplan/utils/scheduler"
-	"github.com/sunshineplan/utils/txt"
 )
 
 const timeFormat = time.RFC3339Nano
@@ -22,49 +24,176 @@ var recordFile string
 
 var recordMap = container.NewMap[user, *record]()
 
-var now = time.Now()
+// historyDays is how many days of traffic records keep before today,
+// which bounds rolling windows.
+const historyDays = 90
 
-func checkDayChange() {
-	t := time.Now()
-	if now.YearDay() != t.YearDay() {
-		recordMap.Range(func(_ user, v *record) bool {
-			v.today.Add(-v.today.Get())
-			if t.Day() == 1 {
-				v.monthly.Add(-v.monthly.Get())
-			}
-			return true
-		})
-		now = t
+// rollRecords closes the periods of the records of base which have ended
+// by t, in the windows of their limits.
+func rollRecords(base *Base, t time.Time) {
+	base.accounts.Range(func(a auth.Basic, l *limit) bool {
+		if v, ok := recordMap.Load(user{a.Username, false}); ok {
+			v.roll(l.window, t)
+		}
+		return true
+	})
+	base.whitelist.Range(func(a allow, l *limit) bool {
+		if v, ok := recordMap.Load(user{string(a), true}); ok {
+			v.roll(l.window, t)
+		}
+		return true
+	})
+}
+
+type counters struct {
+	today, weekly, monthly, total counter.Counter
+	// traffic of the days before today, the latest first, guarded by
+	// record.mu
+	history []int64
+}
+
+func (c *counters) writer(w io.Writer) io.Writer {
+	return counter.CountWriter(counter.CountWriter(counter.CountWriter(counter.CountWriter(
+		w, &c.total), &c.monthly), &c.weekly), &c.today)
+}
+
+func (c *counters) add(n [3]int64) {
+	c.today.Add(n[0])
+	c.monthly.Add(n[1])
+	c.total.Add(n[2])
+}
+
+func (c *counters) reset() {
+	c.today.Add(-c.today.Get())
+	c.weekly.Add(-c.weekly.Get())
+	c.monthly.Add(-c.monthly.Get())
+	c.total.Add(-c.total.Get())
+	c.history = nil
+}
+
+// push ends today and the days idle after it until a new day, which
+// leaves the day ended days before the new one at history[days-1].
+func (c *counters) push(days int) {
+	today := c.today.Get()
+	c.today.Add(-today)
+	h := make([]int64, min(days, historyDays), historyDays)
+	if days <= historyDays {
+		h[days-1] = today
 	}
+	c.history = append(h, c.history[:min(len(c.history), historyDays-len(h))]...)
 }
 
+// last returns the traffic of the last n days, today included.
+func (c *counters) last(n int) int64 {
+	sum := c.today.Get()
+	for _, i := range c.history[:min(len(c.history), n-1)] {
+		sum += i
+	}
+	return sum
+}
+
+// record holds the traffic of a user, sent to the client as download and
+// received from the client as upload, and the connections the user has
+// open.
 type record struct {
-	today, monthly, total counter.Counter
+	download, upload counters
+	active           atomic.Int64
+
+	mu sync.Mutex
+	// starts of the current day, week and month
+	day, week, month time.Time
+	// highest thresholds warned of in the daily, weekly and monthly windows
+	warned [3]int
+}
+
+// roll closes the periods of the record which have ended by t in window w.
+func (r *record) roll(w window, t time.Time) {
+	day := w.day(t)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	last := r.day
+	if last.IsZero() {
+		last = day
+	}
+	if days := int(math.Round(day.Sub(last).Hours() / 24)); days >= 0 {
+		if days > 0 {
+			r.download.push(days)
+			r.upload.push(days)
+		}
+		r.day = day
+	}
+	if r.week.IsZero() {
+		r.week = w.week(last)
+	}
+	if week := w.week(day); !week.Equal(r.week) {
+		r.download.weekly.Add(-r.download.weekly.Get())
+		r.upload.weekly.Add(-r.upload.weekly.Get())
+		r.week = week
+	}
+	if r.month.IsZero() {
+		r.month = w.month(last)
+	}
+	if month := w.month(day); !month.Equal(r.month) {
+		r.download.monthly.Add(-r.download.monthly.Get())
+		r.upload.monthly.Add(-r.upload.monthly.Get())
+		r.month = month
+	}
 }
 
-func (r *record) writer(w io.Writer) io.Writer {
-	return counter.CountWriter(counter.CountWriter(counter.CountWriter(w, &r.total), &r.monthly), &r.today)
+func (r *record) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.download.reset()
+	r.upload.reset()
 }
 
-func store(user user, today, monthly, total int64) *record {
+func store(user user, download, upload [3]int64) *record {
 	v := new(record)
-	v.today.Add(today)
-	v.monthly.Add(monthly)
-	v.total.Add(total)
+	v.download.add(download)
+	v.upload.add(upload)
 	recordMap.Store(user, v)
 	return v
 }
 
+func loadRecord(user user) *record {
+	if v, ok := recordMap.Load(user); ok {
+		return v
+	}
+	v, _ := recordMap.LoadOrStore(user, new(record))
+	return v
+}
+
+// count counts bytes written to w as download of user.
 func count(user user, w io.Writer) io.Writer {
 	if user.name == "" {
 		return w
 	}
-	if v, ok := recordMap.Load(user); ok {
-		return v.writer(w)
+	return loadRecord(user).download.writer(w)
+}
+
+// countUpload counts bytes written to w as upload of user.
+func countUpload(user user, w io.Writer) io.Writer {
+	if user.name == "" {
+		return w
 	}
-	return store(user, 0, 0, 0).writer(w)
+	return loadRecord(user).upload.writer(w)
 }
 
+// uploadBody counts the request body as upload of user while it is read.
+func uploadBody(user user, r *http.Request) {
+	if user.name == "" || r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(r.Body, countUpload(user, io.Discard)), r.Body}
+}
+
+// parseRecord loads the rows of a record file of the first version: the
+// time it was saved, then name:today:monthly:total of the download of each
+// user, with [w] after the names of whitelist entries. The periods of the
+// records start on the day of the file.
 func parseRecord(rows []string) {
 	if len(rows) == 0 {
 		return
@@ -74,80 +203,50 @@ func parseRecord(rows []string) {
 		errorLogger.Print(err)
 		return
 	}
-	t, now := t.Truncate(24*time.Hour), time.Now().Truncate(24*time.Hour)
+	saved := window{}.day(t)
 	for _, row := range rows[1:] {
+		name, whitelist := row, false
+		if i := strings.Index(row, "[w]:"); i != -1 {
+			name, row, whitelist = row[:i], row[i+4:], true
+		} else if i := strings.IndexRune(row, ':'); i != -1 {
+			name, row = row[:i], row[i+1:]
+		}
 		s := strings.Split(row, ":")
-		var today, monthly, total int64
-		total, err = strconv.ParseInt(s[3], 10, 64)
-		if err != nil {
-			errorLogger.Println(row, err)
+		if len(s) != 3 {
+			errorLogger.Println("invalid record:", name)
 			continue
 		}
-		if t.Year() == now.Year() && t.Month() == now.Month() {
-			monthly, err = strconv.ParseInt(s[2], 10, 64)
-			if err != nil {
-				errorLogger.Println(row, err)
-				continue
-			}
-		}
-		if t.Equal(now) {
-			today, err = strconv.ParseInt(s[1], 10, 64)
-			if err != nil {
-				errorLogger.Println(row, err)
-				continue
+		var n [3]int64
+		for i := range s {
+			if n[i], err = strconv.ParseInt(s[i], 10, 64); err != nil {
+				break
 			}
 		}
-		if before, found := strings.CutSuffix(s[0], "[w]"); found {
-			store(user{before, true}, today, monthly, total)
-		} else {
-			store(user{before, false}, today, monthly, total)
+		if err != nil {
+			errorLogger.Println(name, err)
+			continue
 		}
+		v := store(user{name, whitelist}, n, [3]int64{})
+		v.day = saved
 	}
 }
 
-func saveRecord(base *Base) {
-	f, err := os.CreateTemp("", "")
-	if err != nil {
-		errorLogger.Print(err)
-		return
-	}
-	zw := gzip.NewWriter(f)
-	fmt.Fprintln(zw, time.Now().Format(timeFormat))
-
-	base.accounts.Range(func(a auth.Basic, _ *limit) bool {
-		if v, ok := recordMap.Load(user{a.Username, false}); ok {
-			fmt.Fprintf(zw, "%s:%d:%d:%d\n", a.Username, v.today.Get(), v.monthly.Get(), v.total.Get())
-		}
-		return true
-	})
-	base.whitelist.Range(func(a allow, _ *limit) bool {
-		if v, ok := recordMap.Load(user{string(a), true}); ok {
-			fmt.Fprintf(zw, "%s[w]:%d:%d:%d\n", a, v.today.Get(), v.monthly.Get(), v.total.Get())
-		}
-		return true
-	})
-
-	zw.Close()
-	f.Close()
-	os.Rename(f.Name(), recordFile)
-}
-
 func initRecord(base *Base) {
 	accessLogger.Debug("record file: " + recordFile)
-	if f, err := os.Open(recordFile); err == nil {
-		defer f.Close()
-		if zr, err := gzip.NewReader(f); err == nil {
-			defer zr.Close()
-			if rows, err := txt.ReadAll(zr); err == nil {
-				parseRecord(rows)
-			} else {
-				errorLogger.Print(err)
-			}
-		} else {
+	if err := readRecords(recordFile); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			errorLogger.Print(err)
+		}
+		if err := readRecords(recordFile + ".bak"); err == nil {
+			accessLogger.Print("loaded records from backup")
+		} else if !errors.Is(err, fs.ErrNotExist) {
 			errorLogger.Print(err)
 		}
-	} else {
-		errorLogger.Print(err)
 	}
-	scheduler.NewScheduler().At(scheduler.AtMinute(0)).Do(func(scheduler.Event) { saveRecord(base) })
+	rollRecords(base, time.Now())
+	scheduler.NewScheduler().At(scheduler.AtMinute(0)).Do(func(scheduler.Event) {
+		if err := saveRecord(base); err != nil {
+			errorLogger.Println("failed to save records:", err)
+		}
+	})
 }
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sunshineplan/utils/txt"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dialTimeout  = 15 * time.Second
+	dnsTimeout   = 5 * time.Second
+	maxDNSCache  = 4096
+	minDNSTTL    = 10 * time.Second
+	dnsUDPSize   = 1232
+	dohMediaType = "application/dns-message"
+)
+
+var errNoSuchHost = errors.New("no such host")
+
+// dnsResolver resolves destinations dialed directly. The system resolver
+// is used if it is nil.
+var dnsResolver *Resolver
+
+// dnsUpstream exchanges a DNS message with a server.
+type dnsUpstream interface {
+	exchange(ctx context.Context, msg []byte) ([]byte, error)
+	String() string
+}
+
+// Resolver resolves hosts with static hosts first, then cached answers,
+// then its upstreams in order. Without upstreams it falls back to the
+// system resolver.
+type Resolver struct {
+	upstreams []dnsUpstream
+
+	mu    sync.RWMutex
+	hosts map[string][]net.IP
+	cache map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// NewResolver returns a resolver using the comma-separated upstreams:
+//
+//	https://1.1.1.1/dns-query    DNS over HTTPS
+//	tls://dns.google             DNS over TLS, port 853 by default
+//	udp://8.8.8.8 or 8.8.8.8     plain DNS, port 53 by default
+func NewResolver(upstreams string) (*Resolver, error) {
+	r := &Resolver{hosts: make(map[string][]net.IP), cache: make(map[string]dnsCacheEntry)}
+	for s := range strings.SplitSeq(upstreams, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.Contains(s, "://") {
+			s = "udp://" + s
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "https":
+			r.upstreams = append(r.upstreams, &dohUpstream{u.String(), &http.Client{Timeout: dnsTimeout}})
+		case "tls":
+			r.upstreams = append(r.upstreams, &dotUpstream{hostPort(u.Host, "853"), &tls.Config{ServerName: u.Hostname()}})
+		case "udp":
+			r.upstreams = append(r.upstreams, udpUpstream(hostPort(u.Host, "53")))
+		default:
+			return nil, errors.New("unsupported DNS upstream: " + s)
+		}
+	}
+	return r, nil
+}
+
+func hostPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// SetHosts replaces the static hosts with rows in the format of
+// /etc/hosts: an IP followed by its names.
+func (r *Resolver) SetHosts(rows []string) {
+	hosts := make(map[string][]net.IP)
+	for _, row := range rows {
+		if i := strings.IndexByte(row, '#'); i != -1 {
+			row = row[:i]
+		}
+		fields := strings.Fields(row)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	r.mu.Lock()
+	r.hosts = hosts
+	r.mu.Unlock()
+}
+
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	r.mu.RLock()
+	ips, ok := r.hosts[name]
+	entry, cached := r.cache[name]
+	r.mu.RUnlock()
+	if ok {
+		return ips, nil
+	}
+	if cached && time.Now().Before(entry.expires) {
+		return entry.ips, nil
+	}
+	if len(r.upstreams) == 0 {
+		return net.DefaultResolver.LookupIP(ctx, "ip", host)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	var res [2]struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	for i, t := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		wg.Go(func() { res[i].ips, res[i].ttl, res[i].err = r.query(ctx, name, t) })
+	}
+	wg.Wait()
+	ips = append(res[0].ips, res[1].ips...)
+	if len(ips) == 0 {
+		for _, i := range res {
+			if i.err != nil && !errors.Is(i.err, errNoSuchHost) {
+				return nil, i.err
+			}
+		}
+		return nil, &net.DNSError{Err: errNoSuchHost.Error(), Name: host, IsNotFound: true}
+	}
+	ttl := res[0].ttl
+	if len(res[0].ips) == 0 || len(res[1].ips) != 0 && res[1].ttl < ttl {
+		ttl = res[1].ttl
+	}
+	r.mu.Lock()
+	if len(r.cache) >= maxDNSCache {
+		clear(r.cache)
+	}
+	r.cache[name] = dnsCacheEntry{ips, time.Now().Add(max(ttl, minDNSTTL))}
+	r.mu.Unlock()
+	return ips, nil
+}
+
+// query asks the upstreams in order for records of type t.
+func (r *Resolver) query(ctx context.Context, name string, t dnsmessage.Type) (ips []net.IP, ttl time.Duration, err error) {
+	id := uint16(rand.Uint32())
+	msg, err := newDNSQuery(id, name, t)
+	if err != nil {
+		return
+	}
+	for _, upstream := range r.upstreams {
+		var b []byte
+		if b, err = upstream.exchange(ctx, msg); err == nil {
+			if ips, ttl, err = parseDNSAnswer(b, id, t); err == nil || errors.Is(err, errNoSuchHost) {
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		errorLogger.Printf("dns %s: %s", upstream, err)
+	}
+	return
+}
+
+func newDNSQuery(id uint16, name string, t dnsmessage.Type) ([]byte, error) {
+	n, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: n, Type: t, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+func parseDNSAnswer(b []byte, id uint16, t dnsmessage.Type) (ips []net.IP, ttl time.Duration, err error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil {
+		return
+	}
+	if h.ID != id || !h.Response {
+		return nil, 0, errors.New("unexpected DNS response")
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, errNoSuchHost
+	default:
+		return nil, 0, errors.New("DNS response: " + h.RCode.String())
+	}
+	if err = p.SkipAllQuestions(); err != nil {
+		return
+	}
+	for {
+		var rh dnsmessage.ResourceHeader
+		if rh, err = p.AnswerHeader(); err != nil {
+			if err == dnsmessage.ErrSectionDone {
+				err = nil
+			}
+			return
+		}
+		if rh.Type != t {
+			if err = p.SkipAnswer(); err != nil {
+				return
+			}
+			continue
+		}
+		if d := time.Duration(rh.TTL) * time.Second; len(ips) == 0 || d < ttl {
+			ttl = d
+		}
+		switch t {
+		case dnsmessage.TypeA:
+			var a dnsmessage.AResource
+			if a, err = p.AResource(); err != nil {
+				return
+			}
+			ips = append(ips, net.IP(a.A[:]))
+		case dnsmessage.TypeAAAA:
+			var aaaa dnsmessage.AAAAResource
+			if aaaa, err = p.AAAAResource(); err != nil {
+				return
+			}
+			ips = append(ips, net.IP(aaaa.AAAA[:]))
+		}
+	}
+}
+
+// udpUpstream is a plain DNS server, asked again over TCP if the answer
+// is truncated.
+type udpUpstream string
+
+func (u udpUpstream) String() string { return "udp://" + string(u) }
+
+func (u udpUpstream) exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", string(u))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	b := make([]byte, dnsUDPSize)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		// ignore stray responses to other queries
+		if n < 12 || !bytes.Equal(b[:2], msg[:2]) {
+			continue
+		}
+		if b[2]&0x02 != 0 { // truncated
+			conn, err := d.DialContext(ctx, "tcp", string(u))
+			if err != nil {
+				return nil, err
+			}
+			defer conn.Close()
+			return exchangeStream(ctx, conn, msg)
+		}
+		return b[:n], nil
+	}
+}
+
+// dotUpstream is a DNS over TLS server.
+type dotUpstream struct {
+	addr   string
+	config *tls.Config
+}
+
+func (u *dotUpstream) String() string { return "tls://" + u.addr }
+
+func (u *dotUpstream) exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	d := tls.Dialer{Config: u.config}
+	conn, err := d.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return exchangeStream(ctx, conn, msg)
+}
+
+// exchangeStream exchanges msg over a stream with the two-byte length
+// prefix of RFC 1035.
+func exchangeStream(ctx context.Context, conn net.Conn, msg []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)); err != nil {
+		return nil, err
+	}
+	var n uint16
+	if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// dohUpstream is a DNS over HTTPS server (RFC 8484).
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *dohUpstream) String() string { return u.url }
+
+func (u *dohUpstream) exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("DoH response: " + resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// dialDirect connects to address directly, resolving its host with
+// dnsResolver if it is set. Addresses are checked as the ACL of ctx
+// requires.
+func dialDirect(ctx context.Context, network, address string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: dialTimeout, Control: dialControl(ctx)}
+	if dnsResolver == nil {
+		return d.DialContext(ctx, network, address)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := dnsResolver.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// direct dials destinations with dialDirect.
+type direct struct{}
+
+func (direct) Dial(network, address string) (net.Conn, error) {
+	return dialDirect(context.Background(), network, address)
+}
+
+func (direct) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return dialDirect(ctx, network, address)
+}
+
+// directTransport makes HTTP requests of the server with dialDirect.
+var directTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = dialDirect
+	return t
+}()
+
+func initResolver(upstreams, hosts string) error {
+	if upstreams == "" && hosts == "" {
+		return nil
+	}
+	r, err := NewResolver(upstreams)
+	if err != nil {
+		return err
+	}
+	if hosts != "" {
+		accessLogger.Debug("hosts: " + hosts)
+		if rows, err := txt.ReadFile(hosts); err != nil {
+			errorLogger.Println("failed to load hosts file:", err)
+		} else {
+			r.SetHosts(rows)
+		}
+		if err := watchFile(
+			hosts,
+			func() {
+				if rows, err := txt.ReadFile(hosts); err != nil {
+					errorLogger.Print(err)
+				} else {
+					r.SetHosts(rows)
+				}
+			},
+			func() { r.SetHosts(nil) },
+		); err != nil {
+			errorLogger.Print(err)
+		}
+	}
+	dnsResolver = r
+	return nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"net"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// maxIncludeDepth limits nested include rules.
+const maxIncludeDepth = 10
+
+// rules is a set of autoproxy rules, matched against destination hosts.
+type rules struct {
+	zones    map[string]bool
+	hosts    map[string]bool
+	keywords []string
+	regexps  []*regexp.Regexp
+	ips      []net.IP
+	networks []*net.IPNet
+	matchers []ipMatcher
+}
+
+func newRules() *rules {
+	return &rules{zones: make(map[string]bool), hosts: make(map[string]bool)}
+}
+
+// addFromString adds comma-separated values as in [proxy.PerHost.AddFromString].
+func (r *rules) addFromString(s string) {
+	for host := range strings.SplitSeq(s, ",") {
+		host = strings.TrimSpace(host)
+		if len(host) == 0 {
+			continue
+		}
+		if strings.Contains(host, "/") {
+			if _, network, err := net.ParseCIDR(host); err == nil {
+				r.networks = append(r.networks, network)
+			}
+			continue
+		}
+		if ip, err := netip.ParseAddr(host); err == nil {
+			r.ips = append(r.ips, net.IP(ip.AsSlice()))
+			continue
+		}
+		if strings.HasPrefix(host, "*.") {
+			r.addZone(host[1:])
+			continue
+		}
+		r.addHost(host)
+	}
+}
+
+func (r *rules) addZone(zone string) {
+	r.zones[strings.ToLower(strings.Trim(zone, "."))] = true
+}
+
+func (r *rules) addHost(host string) {
+	r.hosts[strings.ToLower(strings.TrimSuffix(host, "."))] = true
+}
+
+func (r *rules) addKeyword(keyword string) {
+	r.keywords = append(r.keywords, strings.ToLower(keyword))
+}
+
+func (r *rules) addRegexp(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	r.regexps = append(r.regexps, re)
+	return nil
+}
+
+func (r *rules) empty() bool {
+	return len(r.zones) == 0 && len(r.hosts) == 0 && len(r.keywords) == 0 &&
+		len(r.regexps) == 0 && !r.hasIP()
+}
+
+// hasIP reports whether r has rules on destination addresses.
+func (r *rules) hasIP() bool {
+	return len(r.ips) != 0 || len(r.networks) != 0 || len(r.matchers) != 0
+}
+
+// merge adds all rules of o to r.
+func (r *rules) merge(o *rules) {
+	maps.Copy(r.zones, o.zones)
+	maps.Copy(r.hosts, o.hosts)
+	r.keywords = append(r.keywords, o.keywords...)
+	r.regexps = append(r.regexps, o.regexps...)
+	r.ips = append(r.ips, o.ips...)
+	r.networks = append(r.networks, o.networks...)
+	r.matchers = append(r.matchers, o.matchers...)
+}
+
+// match reports whether host matches the rules.
+func (r *rules) match(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		for _, i := range r.ips {
+			if i.Equal(ip) {
+				return true
+			}
+		}
+		for _, network := range r.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		for _, m := range r.matchers {
+			if m.matchIP(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if r.hosts[host] {
+		return true
+	}
+	for s := host; ; {
+		if r.zones[s] {
+			return true
+		}
+		i := strings.IndexByte(s, '.')
+		if i == -1 {
+			break
+		}
+		s = s[i+1:]
+	}
+	for _, keyword := range r.keywords {
+		if strings.Contains(host, keyword) {
+			return true
+		}
+	}
+	for _, re := range r.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// attrFilter selects entries of a domain list by attributes, written as
+// in the include rule of domain-list-community: "@attr" keeps only entries
+// with the attribute and "@-attr" drops entries with it.
+type attrFilter struct {
+	require []string
+	exclude []string
+}
+
+func parseAttrFilter(s string) (f attrFilter, err error) {
+	for _, i := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+		attr, ok := strings.CutPrefix(i, "@")
+		if !ok || attr == "" || attr == "-" {
+			return attrFilter{}, errors.New("bad attribute filter: " + i)
+		}
+		if attr, ok := strings.CutPrefix(attr, "-"); ok {
+			f.exclude = append(f.exclude, attr)
+		} else {
+			f.require = append(f.require, attr)
+		}
+	}
+	return
+}
+
+func (f attrFilter) and(g attrFilter) attrFilter {
+	return attrFilter{
+		require: append(append([]string(nil), f.require...), g.require...),
+		exclude: append(append([]string(nil), f.exclude...), g.exclude...),
+	}
+}
+
+func (f attrFilter) match(attrs []string) bool {
+	has := func(attr string) bool {
+		for _, i := range attrs {
+			if i == attr {
+				return true
+			}
+		}
+		return false
+	}
+	for _, attr := range f.require {
+		if !has(attr) {
+			return false
+		}
+	}
+	for _, attr := range f.exclude {
+		if has(attr) {
+			return false
+		}
+	}
+	return true
+}
+
+// domainRule is one line of a domain list.
+type domainRule struct {
+	kind  string
+	value string
+	attrs []string
+}
+
+// parseDomainRule parses a line of a domain list in either the source
+// format "type:value @attr @attr" or the release format
+// "type:value:@attr,@attr". A line without type is a domain rule.
+func parseDomainRule(line string) (rule domainRule, ok bool) {
+	if i := strings.IndexByte(line, '#'); i != -1 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+	rule.kind, rule.value = "domain", fields[0]
+	if kind, value, found := strings.Cut(fields[0], ":"); found && isDomainRuleKind(kind) {
+		rule.kind, rule.value = kind, value
+	}
+	if value, attrs, found := strings.Cut(rule.value, ":@"); found {
+		rule.value = value
+		for attr := range strings.SplitSeq(attrs, ",") {
+			rule.attrs = append(rule.attrs, strings.TrimPrefix(attr, "@"))
+		}
+	}
+	for _, i := range fields[1:] {
+		if rule.kind == "include" {
+			// attributes of an include rule are its filter
+			rule.attrs = append(rule.attrs, i)
+		} else if attr, ok := strings.CutPrefix(i, "@"); ok {
+			rule.attrs = append(rule.attrs, attr)
+		}
+	}
+	return rule, rule.value != ""
+}
+
+func isDomainRuleKind(kind string) bool {
+	switch kind {
+	case "domain", "full", "keyword", "regexp", "include":
+		return true
+	}
+	return false
+}
+
+// domainList adds domain lists to rules, resolving include rules with
+// include, which returns the content of the named list.
+type domainList struct {
+	r       *rules
+	include func(name string) (string, error)
+}
+
+func (l *domainList) add(s string, filter attrFilter) {
+	l.addList(s, filter, nil)
+}
+
+func (l *domainList) addList(s string, filter attrFilter, parents []string) {
+	for line := range strings.Lines(s) {
+		rule, ok := parseDomainRule(line)
+		if !ok {
+			continue
+		}
+		if rule.kind == "include" {
+			l.addInclude(rule, filter, parents)
+			continue
+		}
+		if !filter.match(rule.attrs) {
+			continue
+		}
+		switch rule.kind {
+		case "domain":
+			l.r.addZone(rule.value)
+		case "full":
+			l.r.addHost(rule.value)
+		case "keyword":
+			l.r.addKeyword(rule.value)
+		case "regexp":
+			if err := l.r.addRegexp(rule.value); err != nil {
+				errorLogger.Printf("autoproxy: bad regexp rule %q: %s", rule.value, err)
+			}
+		}
+	}
+}
+
+func (l *domainList) addInclude(rule domainRule, filter attrFilter, parents []string) {
+	name := strings.ToLower(rule.value)
+	for _, i := range parents {
+		if i == name {
+			errorLogger.Printf("autoproxy: include loop: %s -> %s", strings.Join(parents, " -> "), name)
+			return
+		}
+	}
+	if len(parents) >= maxIncludeDepth {
+		errorLogger.Printf("autoproxy: include %s: too deep", name)
+		return
+	}
+	f, err := parseAttrFilter(strings.Join(rule.attrs, " "))
+	if err != nil {
+		errorLogger.Printf("autoproxy: include %s: %s", name, err)
+		return
+	}
+	if l.include == nil {
+		errorLogger.Printf("autoproxy: include %s: not supported", name)
+		return
+	}
+	s, err := l.include(name)
+	if err != nil {
+		errorLogger.Printf("autoproxy: include %s: %s", name, err)
+		return
+	}
+	l.addList(s, filter.and(f), append(parents[:len(parents):len(parents)], name))
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"errors"
 	"net"
 	"net/url"
 	"strconv"
+	"strings"
 
+	"github.com/sunshineplan/httpproxy/auth"
 	"github.com/sunshineplan/utils/httpsvr"
 	"golang.org/x/net/proxy"
 )
@@ -19,43 +22,150 @@ type Runner interface {
 }
 
 func run() error {
-	base := NewBase(*host, *port)
+	base := NewBase(*host, *port).SetDigest(*digest)
 	base.ErrorLog = errorLogger.Logger
+	if err := initResolver(*dns, *hostsFile); err != nil {
+		return err
+	}
+	if err := initShaper(); err != nil {
+		return err
+	}
+	if err := initNotifier(*webhook, *hookScript, *warnings); err != nil {
+		return err
+	}
 	servers := []*httpsvr.Server{base.Server}
 	var runner Runner
+	var pool *Pool
+	var socks *SOCKS
+	var transparent *Transparent
 	if *proxyAddr == "" {
 		if base.Port == "" {
 			base.Port = defaultServerPort
 		}
-		s := NewServer(base)
+		connectPorts, err := parsePorts(*ports)
+		if err != nil {
+			return err
+		}
+		s := NewServer(base).SetACL(initACL(*aclFile, connectPorts))
 		if *https {
 			s.SetTLS(*cert, *privkey)
 		}
+		if *socksPort != "" {
+			socks = s.SOCKS(*socksPort)
+		}
 		runner = s
 	} else {
 		if base.Port == "" {
 			base.Port = defaultClientPort
 		}
-		c, err := NewClient(base, parseProxy(*proxyAddr))
+		strategy, err := parseStrategy(*balance)
 		if err != nil {
 			return err
 		}
+		c, err := NewClient(base, parseProxies(*proxyAddr)...)
+		if err != nil {
+			return err
+		}
+		c.SetStrategy(strategy).SetHealthCheck(*healthCheck, *healthInterval).SetSniff(*sniff)
 		if *username != "" || *password != "" {
 			c.SetProxyAuth(&proxy.Auth{User: *username, Password: *password})
+			switch strings.ToLower(*scheme) {
+			case "basic":
+			case "digest":
+				c.SetAuthorization(&auth.Digest{Username: *username, Password: *password})
+			case "bearer":
+				c.SetAuthorization(auth.Bearer{Token: *password})
+			default:
+				return errors.New("unsupported authentication scheme: " + *scheme)
+			}
 		}
 		if *autoproxy != "" {
-			c.SetAutoproxy(*autoproxy, initAutoproxy(c))
+			if autoproxyFilter, err = parseAttrFilter(*autoproxyAttrs); err != nil {
+				return err
+			}
+			if *autoproxyRefresh <= 0 {
+				return errors.New("bad autoproxy refresh interval: " + autoproxyRefresh.String())
+			}
+			autoproxyInterval, autoproxyCache = *autoproxyRefresh, *cacheDir
+			sources, err := parseSources(*autoproxySource, autoproxyFilter)
+			if err != nil {
+				return err
+			}
+			outbounds, err := parseOutbounds(*outbound)
+			if err != nil {
+				return err
+			}
+			if err := checkOutbounds(sources, outbounds); err != nil {
+				return err
+			}
+			for name, u := range outbounds {
+				if err := c.SetOutbound(name, u...); err != nil {
+					return err
+				}
+			}
+			c.SetAutoproxy(*autoproxy, initAutoproxy(c, sources))
 			servers = append(servers, c.autoproxy.Server)
 		}
+		if *socksPort != "" {
+			socks = c.SOCKS(*socksPort)
+		}
+		if *transparentPort != "" {
+			transparent = c.Transparent(*transparentPort, *tproxy)
+		}
 		runner = c
+		pool = c.proxy
 	}
 	base.accounts = initSecrets(*secrets)
 	base.whitelist = initWhitelist(*whitelist)
 	initRecord(base)
-	initStatus(base, servers)
+	initStatus(base, servers, pool)
+	if *admin != "" {
+		if *token == "" {
+			errorLogger.Print("admin API is disabled without admin token")
+		} else {
+			go func() {
+				if err := NewAdmin(base, *admin, *token, *secrets, *whitelist).Run(); err != nil {
+					errorLogger.Println("failed to run admin:", err)
+				}
+			}()
+		}
+	}
+	if socks != nil {
+		go func() {
+			if err := socks.Run(); err != nil {
+				errorLogger.Println("failed to run socks:", err)
+			}
+		}()
+	}
+	if transparent != nil {
+		go func() {
+			if err := transparent.Run(); err != nil {
+				errorLogger.Println("failed to run transparent proxy:", err)
+			}
+		}()
+	}
+	if *metricsPort != "" {
+		go func() {
+			if err := NewMetrics(base, *metricsPort).Run(); err != nil {
+				errorLogger.Println("failed to run metrics:", err)
+			}
+		}()
+	}
 	defer func() {
-		saveRecord(base)
-		saveStatus(base, servers)
+		if socks != nil {
+			if err := socks.Close(); err != nil {
+				errorLogger.Println("failed to close socks:", err)
+			}
+		}
+		if transparent != nil {
+			if err := transparent.Close(); err != nil {
+				errorLogger.Println("failed to close transparent proxy:", err)
+			}
+		}
+		if err := saveRecord(base); err != nil {
+			errorLogger.Println("failed to save records:", err)
+		}
+		saveStatus(base, servers, pool)
 	}()
 	return runner.Run()
 }
@@ -80,8 +190,48 @@ func test() error {
 	}
 	l.Close()
 
+	if _, err := NewResolver(*dns); err != nil {
+		return err
+	}
+	if _, _, err := parseBandwidth(*bandwidth, *listenerBW); err != nil {
+		return err
+	}
+	if _, err := parseThresholds(*warnings, ","); err != nil {
+		return err
+	}
+
+	if *proxyAddr == "" {
+		if _, err := parsePorts(*ports); err != nil {
+			return err
+		}
+	}
+
 	if *proxyAddr != "" {
-		if _, err := url.Parse(*proxyAddr); err != nil {
+		for s := range strings.SplitSeq(*proxyAddr, ",") {
+			if _, err := url.Parse(strings.TrimSpace(s)); err != nil {
+				return err
+			}
+		}
+		if _, err := parseStrategy(*balance); err != nil {
+			return err
+		}
+		filter, err := parseAttrFilter(*autoproxyAttrs)
+		if err != nil {
+			return err
+		}
+		if *autoproxyRefresh <= 0 {
+			return errors.New("bad autoproxy refresh interval: " + autoproxyRefresh.String())
+		}
+		autoproxyInterval = *autoproxyRefresh
+		sources, err := parseSources(*autoproxySource, filter)
+		if err != nil {
+			return err
+		}
+		outbounds, err := parseOutbounds(*outbound)
+		if err != nil {
+			return err
+		}
+		if err := checkOutbounds(sources, outbounds); err != nil {
 			return err
 		}
 	}
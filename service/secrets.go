@@ -35,10 +35,14 @@ func initSecrets(file string) *container.Map[auth.Basic, *limit] {
 				errorLogger.Print(err)
 			} else {
 				accounts.Clear()
+				verified.Clear()
 				parseSecrets(accounts, rows)
 			}
 		},
-		accounts.Clear,
+		func() {
+			accounts.Clear()
+			verified.Clear()
+		},
 	); err != nil {
 		errorLogger.Print(err)
 	}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
-	"github.com/sunshineplan/limiter"
+	"github.com/sunshineplan/httpproxy/masque"
 )
 
 type Server struct {
@@ -15,6 +18,7 @@ type Server struct {
 	tls     bool
 	cert    string
 	privkey string
+	acl     *ACL
 }
 
 func NewServer(base *Base) *Server {
@@ -29,11 +33,54 @@ func NewServer(base *Base) *Server {
 
 func (s *Server) SetTLS(cert, privkey string) *Server {
 	s.tls = true
+	s.TLSNextProto = nil
 	s.cert = cert
 	s.privkey = privkey
 	return s
 }
 
+// SetACL limits the destinations users may reach.
+func (s *Server) SetACL(acl *ACL) *Server {
+	s.acl = acl
+	return s
+}
+
+// allow checks address against the ACL and returns r with the context to
+// dial it with. A denied request is answered with 403 Forbidden.
+func (s *Server) allow(u user, w http.ResponseWriter, r *http.Request, address string, connect bool) (*http.Request, bool) {
+	if s.acl == nil {
+		return r, true
+	}
+	ctx, err := s.acl.check(r.Context(), u, address, connect)
+	if err != nil {
+		logDenied(r.RemoteAddr, u, address, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return r, false
+	}
+	return r.WithContext(ctx), true
+}
+
+// logDenied logs a destination refused by the ACL.
+func logDenied(remoteAddr string, u user, address string, err error) {
+	metrics.denied.Add(1)
+	var name string
+	if u.name != "" {
+		name = "[" + u.name + "]"
+	}
+	accessLogger.Printf("%s%s %s: %s", remoteAddr, name, address, err)
+}
+
+// dialFailed answers a request whose destination could not be dialed,
+// with 403 Forbidden if the dialed address was refused by the ACL.
+func dialFailed(w http.ResponseWriter, r *http.Request, u user, address string, err error) {
+	if d := denied(""); errors.As(err, &d) {
+		logDenied(r.RemoteAddr, u, address, d)
+		http.Error(w, d.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+}
+
 func (s *Server) Run() error {
 	if s.tls {
 		return s.RunTLS(s.cert, s.privkey)
@@ -41,10 +88,22 @@ func (s *Server) Run() error {
 	return s.Base.Run()
 }
 
-func (*Server) HTTP(user user, lim *limiter.Limiter, w http.ResponseWriter, r *http.Request) {
-	resp, err := http.DefaultTransport.RoundTrip(r)
+func (s *Server) HTTP(user user, lim *flow, w http.ResponseWriter, r *http.Request) {
+	port := r.URL.Port()
+	if port == "" {
+		port = "80"
+		if r.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	r, ok := s.allow(user, w, r, net.JoinHostPort(r.URL.Hostname(), port), false)
+	if !ok {
+		return
+	}
+	uploadBody(user, r)
+	resp, err := directTransport.RoundTrip(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		dialFailed(w, r, user, r.URL.Host, err)
 		return
 	}
 	defer resp.Body.Close()
@@ -59,10 +118,21 @@ func (*Server) HTTP(user user, lim *limiter.Limiter, w http.ResponseWriter, r *h
 	io.Copy(count(user, lim.Writer(w)), resp.Body)
 }
 
-func (*Server) HTTPS(u user, lim *limiter.Limiter, w http.ResponseWriter, r *http.Request) {
-	dest_conn, err := net.DialTimeout("tcp", r.Host, 15*time.Second)
+func (s *Server) HTTPS(u user, lim *flow, w http.ResponseWriter, r *http.Request) {
+	r, ok := s.allow(u, w, r, r.Host, true)
+	if !ok {
+		return
+	}
+	start := time.Now()
+	dest_conn, err := dialDirect(r.Context(), "tcp", r.Host)
+	observeDial(UseDirect, start)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		dialFailed(w, r, u, r.Host, err)
+		return
+	}
+
+	if r.ProtoMajor == 2 {
+		tunnel(dest_conn, w, r, u, lim)
 		return
 	}
 
@@ -81,22 +151,95 @@ func (*Server) HTTPS(u user, lim *limiter.Limiter, w http.ResponseWriter, r *htt
 		return
 	}
 
-	go transfer(dest_conn, client_conn, user{}, nil)
-	go transfer(client_conn, dest_conn, u, lim)
+	pipe(client_conn, dest_conn, u, lim)
+}
+
+func (s *Server) UDP(u user, lim *flow, w http.ResponseWriter, r *http.Request) {
+	target, err := masque.ParsePath(r.URL.EscapedPath())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r, ok := s.allow(u, w, r, target, false)
+	if !ok {
+		return
+	}
+	start := time.Now()
+	dest_conn, err := dialDirect(r.Context(), "udp", target)
+	observeDial(UseDirect, start)
+	if err != nil {
+		dialFailed(w, r, u, target, err)
+		return
+	}
+
+	if r.ProtoMajor == 2 {
+		defer dest_conn.Close()
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+		w.Header().Set("Capsule-Protocol", "?1")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		relay(dest_conn, bufio.NewReader(r.Body), flushWriter{w, rc}, u, lim)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		dest_conn.Close()
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	client_conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		dest_conn.Close()
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	client_conn.SetDeadline(time.Time{})
+	if _, err := io.WriteString(client_conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Connection: Upgrade\r\nUpgrade: "+masque.Protocol+"\r\nCapsule-Protocol: ?1\r\n\r\n"); err != nil {
+		dest_conn.Close()
+		client_conn.Close()
+		return
+	}
+
+	defer client_conn.Close()
+	relay(dest_conn, brw.Reader, client_conn, u, lim)
+}
+
+func isConnectUDP(r *http.Request) bool {
+	if r.Method == http.MethodConnect {
+		return r.Header.Get(":protocol") == masque.Protocol
+	}
+	return r.Method == http.MethodGet && strings.EqualFold(r.Header.Get("Upgrade"), masque.Protocol)
 }
 
 func (s *Server) Handler(w http.ResponseWriter, r *http.Request) {
-	user, lim, ok := s.Auth(w, r)
+	w, done := withLog(w, r)
+	defer done()
+	user, speed, ok := s.Auth(w, r)
 	if !ok {
 		return
 	}
+	defer leave(user)
+	lim := shape("main", user, r.RemoteAddr, speed)
+	defer lim.leave()
+	setUser(w, user)
+	setDialer(w, UseDirect)
 
 	var name string
 	if user.name != "" {
 		name = "[" + user.name + "]"
 	}
 	accessLogger.Printf("[S]%s%s %s %s", r.RemoteAddr, name, r.Method, r.URL)
-	if r.Method == http.MethodConnect {
+	metrics.requests.with(requestKind(r)).Add(1)
+	if isConnectUDP(r) {
+		s.UDP(user, lim, w, r)
+	} else if r.Method == http.MethodConnect {
 		s.HTTPS(user, lim, w, r)
 	} else {
 		s.HTTP(user, lim, w, r)
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/sunshineplan/limiter"
+	"github.com/sunshineplan/utils/txt"
+	"github.com/sunshineplan/utils/unit"
+	"golang.org/x/time/rate"
+)
+
+// shapeQuantum is the most a flow sends at a time under a cap, so that
+// the flows waiting for it take turns.
+const shapeQuantum = 32 << 10
+
+// shapedListeners are the listeners which may have a bandwidth cap.
+var shapedListeners = []string{"main", "autoproxy", "socks", "transparent"}
+
+var shaper = NewShaper()
+
+// shapeNode is a cap of the shaper, or a user sharing the cap of its
+// parent.
+type shapeNode struct {
+	parent *shapeNode
+	lim    atomic.Pointer[rate.Limiter]
+	// mu keeps at most one pending request of the node at its parent,
+	// which serves the children of a node in turn.
+	mu sync.Mutex
+
+	// guarded by Shaper.mu
+	children map[string]*shapeNode
+	flows    int
+}
+
+func (n *shapeNode) setLimit(bs unit.ByteSize) {
+	if bs == 0 {
+		n.lim.Store(nil)
+	} else {
+		n.lim.Store(rate.NewLimiter(rate.Limit(bs), shapeQuantum))
+	}
+}
+
+// limited reports whether n or any of its parents has a cap.
+func (n *shapeNode) limited() bool {
+	for ; n != nil; n = n.parent {
+		if n.lim.Load() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// wait blocks until n and its parents allow size bytes.
+func (n *shapeNode) wait(size int) {
+	if lim := n.lim.Load(); lim != nil {
+		lim.WaitN(context.Background(), size)
+	}
+	if !n.parent.limited() {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.parent.wait(size)
+}
+
+// Shaper shapes the bandwidth sent to clients hierarchically: a global
+// cap, a cap of each listener, and the users of a listener sharing it
+// fairly, each within its own speed limit.
+type Shaper struct {
+	mu        sync.Mutex
+	global    *shapeNode
+	listeners map[string]*shapeNode
+}
+
+// NewShaper returns a Shaper without caps.
+func NewShaper() *Shaper {
+	s := &Shaper{global: new(shapeNode), listeners: make(map[string]*shapeNode)}
+	for _, name := range shapedListeners {
+		s.listeners[name] = &shapeNode{parent: s.global, children: make(map[string]*shapeNode)}
+	}
+	return s
+}
+
+// set replaces the caps of the shaper. Zero is no cap. Flows already
+// running follow the new caps.
+func (s *Shaper) set(total unit.ByteSize, listeners map[string]unit.ByteSize) {
+	s.global.setLimit(total)
+	for name, n := range s.listeners {
+		n.setLimit(listeners[name])
+	}
+}
+
+// join starts a flow of the user named key on listener, which the caller
+// ends by leave.
+func (s *Shaper) join(listener, key string, speed *limiter.Limiter) *flow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	parent := s.listeners[listener]
+	n, ok := parent.children[key]
+	if !ok {
+		n = &shapeNode{parent: parent}
+		parent.children[key] = n
+	}
+	n.flows++
+	return &flow{s, listener, key, n, speed}
+}
+
+// flow is what a connection sends to its client through: the speed limit
+// of its user, and the user's share of its listener and the global caps.
+type flow struct {
+	shaper   *Shaper
+	listener string
+	key      string
+	node     *shapeNode
+	speed    *limiter.Limiter
+}
+
+func (f *flow) leave() {
+	f.shaper.mu.Lock()
+	defer f.shaper.mu.Unlock()
+	if f.node.flows--; f.node.flows == 0 {
+		delete(f.shaper.listeners[f.listener].children, f.key)
+	}
+}
+
+func (f *flow) Writer(w io.Writer) io.Writer {
+	if f.speed != nil {
+		w = f.speed.Writer(w)
+	}
+	return &shapedWriter{f.node, w}
+}
+
+type shapedWriter struct {
+	node *shapeNode
+	w    io.Writer
+}
+
+func (w *shapedWriter) Write(p []byte) (n int, err error) {
+	if !w.node.limited() {
+		return w.w.Write(p)
+	}
+	for len(p) > 0 {
+		b := p[:min(len(p), shapeQuantum)]
+		w.node.wait(len(b))
+		m, err := w.w.Write(b)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[len(b):]
+	}
+	return
+}
+
+// shape starts a flow of u connected from remoteAddr on listener. Clients
+// without a user share by address.
+func shape(listener string, u user, remoteAddr string, speed *limiter.Limiter) *flow {
+	key := u.name
+	if key == "" {
+		if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+			key = host
+		} else {
+			key = remoteAddr
+		}
+	}
+	return shaper.join(listener, key, speed)
+}
+
+// parseBandwidth parses the global cap and the comma-separated caps of
+// listeners, such as main=10MB,autoproxy=5MB.
+func parseBandwidth(total, listeners string) (unit.ByteSize, map[string]unit.ByteSize, error) {
+	var bs unit.ByteSize
+	if total = strings.TrimSpace(total); total != "" {
+		var err error
+		if bs, err = unit.ParseByteSize(total); err != nil {
+			return 0, nil, err
+		}
+	}
+	m := make(map[string]unit.ByteSize)
+	for i := range strings.SplitSeq(listeners, ",") {
+		if i = strings.TrimSpace(i); i == "" {
+			continue
+		}
+		name, size, ok := strings.Cut(i, "=")
+		if name = strings.TrimSpace(name); !ok || !slices.Contains(shapedListeners, name) {
+			return 0, nil, errors.New("bad listener bandwidth: " + i)
+		}
+		v, err := unit.ParseByteSize(strings.TrimSpace(size))
+		if err != nil {
+			return 0, nil, err
+		}
+		m[name] = v
+	}
+	return bs, m, nil
+}
+
+// initShaper sets the caps of the shaper from the flags, and again from
+// the config file on SIGHUP.
+func initShaper() error {
+	total, listeners, err := parseBandwidth(*bandwidth, *listenerBW)
+	if err != nil {
+		return err
+	}
+	shaper.set(total, listeners)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			if err := reloadShaper(); err != nil {
+				errorLogger.Println("failed to reload bandwidth:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// reloadShaper sets the caps of the shaper from the bandwidth keys of the
+// config file. The other flags are left as they are, and a key missing
+// from the file removes its caps.
+func reloadShaper() error {
+	var total, listeners string
+	set := flag.NewFlagSet("", flag.ContinueOnError)
+	set.SetOutput(io.Discard)
+	set.StringVar(&total, "bandwidth", "", "")
+	set.StringVar(&listeners, "listener-bandwidth", "", "")
+	rows, err := txt.ReadFile(configFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	var args []string
+	for _, row := range rows {
+		if row = strings.TrimSpace(row); row == "" || strings.HasPrefix(row, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(row, "=")
+		if !ok {
+			return errors.New("bad config line: " + row)
+		}
+		if key = strings.TrimSpace(key); set.Lookup(key) == nil {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if s, err := strconv.Unquote(value); err == nil {
+			value = s
+		}
+		args = append(args, "-"+key+"="+value)
+	}
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+	t, l, err := parseBandwidth(total, listeners)
+	if err != nil {
+		return err
+	}
+	shaper.set(t, l)
+	accessLogger.Printf("reloaded bandwidth: total=%q listeners=%q", total, listeners)
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sniffTimeout = 5 * time.Second
+	maxSniffSize = 16 << 10
+)
+
+var errSniffed = errors.New("sniffed")
+
+// sniffPort reports whether connections to port are sniffed. Clients of
+// other protocols may wait for the server to speak first.
+func sniffPort(port string) bool {
+	return port == "80" || port == "443"
+}
+
+// sniffHost reads the first bytes of conn for the server name of a TLS
+// ClientHello or the Host header of an HTTP request. It returns the name,
+// which is empty if none is found, and a connection replaying what was
+// read.
+func sniffHost(conn net.Conn) (string, net.Conn) {
+	var buf bytes.Buffer
+	r := &sniffReader{conn, &buf}
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	br := bufio.NewReader(r)
+	var host string
+	if b, err := br.Peek(1); err == nil {
+		if b[0] == 0x16 { // TLS handshake record
+			tls.Server(&readOnlyConn{conn, br}, &tls.Config{
+				GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+					host = hello.ServerName
+					return nil, errSniffed
+				},
+			}).Handshake()
+		} else if req, err := http.ReadRequest(br); err == nil {
+			host = req.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+		}
+	}
+	if net.ParseIP(host) != nil || strings.ContainsAny(host, " /") {
+		host = ""
+	}
+	return host, &bufferedConn{conn, bufio.NewReader(io.MultiReader(&buf, conn))}
+}
+
+// sniffReader keeps what is read from a connection, up to maxSniffSize.
+type sniffReader struct {
+	conn net.Conn
+	buf  *bytes.Buffer
+}
+
+func (r *sniffReader) Read(b []byte) (int, error) {
+	if r.buf.Len() >= maxSniffSize {
+		return 0, io.EOF
+	}
+	if len(b) > maxSniffSize-r.buf.Len() {
+		b = b[:maxSniffSize-r.buf.Len()]
+	}
+	n, err := r.conn.Read(b)
+	r.buf.Write(b[:n])
+	return n, err
+}
+
+// readOnlyConn lets a TLS handshake read from r and never write to the
+// connection.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *readOnlyConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+func (c *readOnlyConn) Close() error                { return nil }
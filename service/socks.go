@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sunshineplan/httpproxy/auth"
+	"github.com/sunshineplan/limiter"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929.
+const (
+	socksVersion = 0x05
+
+	socksNoAuth       = 0x00
+	socksUserPass     = 0x02
+	socksNoAcceptable = 0xff
+
+	socksConnect = 0x01
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+
+	socksSucceeded           = 0x00
+	socksGeneralFailure      = 0x01
+	socksNotAllowed          = 0x02
+	socksHostUnreachable     = 0x04
+	socksCommandNotSupported = 0x07
+	socksAddrNotSupported    = 0x08
+)
+
+const socksHandshakeTimeout = 30 * time.Second
+
+// SOCKS serves SOCKS5 on its own listener, sharing the accounts, whitelist
+// and traffic records of Base.
+type SOCKS struct {
+	base *Base
+	Port string
+
+	side string
+	dial func(user, string) (net.Conn, error)
+
+	mu       sync.Mutex
+	listener net.Listener
+	closed   bool
+}
+
+// SOCKS returns a SOCKS5 frontend which connects to destinations directly,
+// as the ACL of the server allows.
+func (s *Server) SOCKS(port string) *SOCKS {
+	return &SOCKS{base: s.Base, Port: port, side: "S", dial: func(u user, address string) (net.Conn, error) {
+		ctx := context.Background()
+		if s.acl != nil {
+			var err error
+			if ctx, err = s.acl.check(ctx, u, address, true); err != nil {
+				return nil, err
+			}
+		}
+		start := time.Now()
+		conn, err := dialDirect(ctx, "tcp", address)
+		observeDial(UseDirect, start)
+		return conn, err
+	}}
+}
+
+// SOCKS returns a SOCKS5 frontend which connects to destinations through
+// the proxy, or as the autoproxy rules decide if autoproxy is enabled.
+func (c *Client) SOCKS(port string) *SOCKS {
+	return &SOCKS{base: c.Base, Port: port, side: "C", dial: func(_ user, address string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := c.dial(address, c.autoproxy != nil)
+		t, _ := IsTyped(conn, err)
+		observeDial(t, start)
+		return conn, err
+	}}
+}
+
+func (s *SOCKS) Run() error {
+	listener, err := net.Listen("tcp", net.JoinHostPort(s.base.Host, s.Port))
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return listener.Close()
+	}
+	s.listener = listener
+	s.mu.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+// Close stops the listener, or keeps Run from starting it if it has not
+// yet.
+func (s *SOCKS) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+func (s *SOCKS) serve(conn net.Conn) {
+	remoteAddr := conn.RemoteAddr().String()
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	br := bufio.NewReader(conn)
+	u, speed, ok := s.auth(conn, br, remoteAddr)
+	if !ok {
+		conn.Close()
+		return
+	}
+	defer leave(u)
+	lim := shape("socks", u, remoteAddr, speed)
+	defer lim.leave()
+	address, code := readSOCKSRequest(br)
+	if code != socksSucceeded {
+		writeSOCKSReply(conn, code, nil)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	conn = &bufferedConn{conn, br}
+
+	var name string
+	if u.name != "" {
+		name = "[" + u.name + "]"
+	}
+	metrics.requests.with("socks").Add(1)
+	dest, err := s.dial(u, address)
+	var direct bool
+	t, ok := IsTyped(dest, err)
+	if ok {
+		accessLogger.Printf("[%s]%s%s SOCKS5 %s", t, remoteAddr, name, address)
+		direct = t == UseDirect && s.side == "C"
+	} else {
+		accessLogger.Printf("[%s]%s%s SOCKS5 %s", s.side, remoteAddr, name, address)
+	}
+	if d := denied(""); errors.As(err, &d) {
+		logDenied(remoteAddr, u, address, d)
+		writeSOCKSReply(conn, socksNotAllowed, nil)
+		conn.Close()
+		return
+	} else if t == UseReject {
+		writeSOCKSReply(conn, socksNotAllowed, nil)
+		conn.Close()
+		return
+	} else if err != nil {
+		writeSOCKSReply(conn, socksHostUnreachable, nil)
+		conn.Close()
+		return
+	}
+	if err := writeSOCKSReply(conn, socksSucceeded, dest.LocalAddr()); err != nil {
+		dest.Close()
+		conn.Close()
+		return
+	}
+
+	if jsonLogger != nil {
+		e := newEntry(remoteAddr, "SOCKS5", address)
+		e.user, e.status = u, socksSucceeded
+		if t, ok := IsTyped(dest, nil); ok {
+			e.dialer = t
+		} else if s.side == "S" {
+			e.dialer = UseDirect
+		} else {
+			e.dialer = UseProxy
+		}
+		conn = &logConn{Conn: conn, e: e}
+	}
+	if direct {
+		pipe(conn, dest, user{}, nil)
+	} else {
+		pipe(conn, dest, u, lim)
+	}
+}
+
+// auth negotiates the authentication method and authenticates the client
+// against the whitelist and accounts of Base. It takes a connection of the
+// user as Base.Auth does.
+func (s *SOCKS) auth(conn net.Conn, br *bufio.Reader, remoteAddr string) (user, *limiter.Limiter, bool) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil || header[0] != socksVersion {
+		return user{}, nil, false
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return user{}, nil, false
+	}
+	offered := func(method byte) bool {
+		for _, i := range methods {
+			if i == method {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch hasWhitelist, hasAccount := s.base.hasWhitelist(), s.base.hasAccount(); {
+	case !hasWhitelist && !hasAccount:
+		if !offered(socksNoAuth) {
+			conn.Write([]byte{socksVersion, socksNoAcceptable})
+			return user{}, nil, false
+		}
+		_, err := conn.Write([]byte{socksVersion, socksNoAuth})
+		return user{}, limiter.New(limiter.Inf), err == nil
+	case hasWhitelist:
+		if found, allow, exceeded, limit := s.base.isAllow(remoteAddr); found {
+			if exceeded {
+				metrics.limitExceeded.Add(1)
+				limit.st.Do(func() { accessLogger.Printf("%s[%s] Exceeded traffic limit", remoteAddr, allow) })
+				conn.Write([]byte{socksVersion, socksNoAcceptable})
+				return user{}, nil, false
+			}
+			if offered(socksNoAuth) {
+				u := user{string(allow), true}
+				if reason, ok := enter(u, limit); !ok {
+					logOverCap(remoteAddr, u, limit, reason)
+					conn.Write([]byte{socksVersion, socksNoAcceptable})
+					return user{}, nil, false
+				}
+				if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+					leave(u)
+					return user{}, nil, false
+				}
+				return u, limit.speed, true
+			}
+		}
+		if !hasAccount {
+			metrics.notAllowed.Add(1)
+			notAllow.Do(func() { accessLogger.Printf("%s not allow", remoteAddr) })
+			conn.Write([]byte{socksVersion, socksNoAcceptable})
+			return user{}, nil, false
+		}
+		fallthrough
+	default:
+		if !offered(socksUserPass) {
+			metrics.authRequired.Add(1)
+			authRequired.Do(func() { accessLogger.Printf("%s Proxy Authentication Required", remoteAddr) })
+			conn.Write([]byte{socksVersion, socksNoAcceptable})
+			return user{}, nil, false
+		}
+		if _, err := conn.Write([]byte{socksVersion, socksUserPass}); err != nil {
+			return user{}, nil, false
+		}
+		account, err := readSOCKSUserPass(br)
+		if err != nil {
+			return user{}, nil, false
+		}
+		if found, exceeded, limit := s.base.checkAccount(account); !found {
+			metrics.authFailed.Add(1)
+			authFailed.Do(func() { errorLogger.Printf("%s Proxy Authentication Failed", remoteAddr) })
+			conn.Write([]byte{0x01, 0x01})
+			return user{}, nil, false
+		} else if exceeded {
+			metrics.limitExceeded.Add(1)
+			limit.st.Do(func() { accessLogger.Printf("%s[%s] Exceeded traffic limit", remoteAddr, account.Username) })
+			conn.Write([]byte{0x01, 0x01})
+			return user{}, nil, false
+		} else {
+			u := user{account.Username, false}
+			if reason, ok := enter(u, limit); !ok {
+				logOverCap(remoteAddr, u, limit, reason)
+				conn.Write([]byte{0x01, 0x01})
+				return user{}, nil, false
+			}
+			if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+				leave(u)
+				return user{}, nil, false
+			}
+			return u, limit.speed, true
+		}
+	}
+}
+
+// readSOCKSUserPass reads the username/password request of RFC 1929.
+func readSOCKSUserPass(br *bufio.Reader) (account auth.Basic, err error) {
+	b := make([]byte, 2)
+	if _, err = io.ReadFull(br, b); err != nil {
+		return
+	}
+	if b[0] != 0x01 {
+		err = errors.New("unsupported username/password version")
+		return
+	}
+	username := make([]byte, b[1])
+	if _, err = io.ReadFull(br, username); err != nil {
+		return
+	}
+	n, err := br.ReadByte()
+	if err != nil {
+		return
+	}
+	password := make([]byte, n)
+	if _, err = io.ReadFull(br, password); err != nil {
+		return
+	}
+	return auth.Basic{Username: string(username), Password: string(password)}, nil
+}
+
+// readSOCKSRequest reads a request and returns its destination address,
+// or the reply code if the request is not supported.
+func readSOCKSRequest(br *bufio.Reader) (string, byte) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(br, b); err != nil || b[0] != socksVersion {
+		return "", socksGeneralFailure
+	}
+	var host string
+	switch b[3] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, 4)
+		if b[3] == socksIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", socksGeneralFailure
+		}
+		host = ip.String()
+	case socksDomain:
+		n, err := br.ReadByte()
+		if err != nil {
+			return "", socksGeneralFailure
+		}
+		domain := make([]byte, n)
+		if _, err := io.ReadFull(br, domain); err != nil {
+			return "", socksGeneralFailure
+		}
+		host = string(domain)
+	default:
+		return "", socksAddrNotSupported
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(br, port); err != nil {
+		return "", socksGeneralFailure
+	}
+	if b[1] != socksConnect {
+		return "", socksCommandNotSupported
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), socksSucceeded
+}
+
+// writeSOCKSReply writes a reply with the bound address addr.
+func writeSOCKSReply(w io.Writer, code byte, addr net.Addr) error {
+	ip, port := net.IPv4zero.To4(), 0
+	if addr, ok := addr.(*net.TCPAddr); ok && addr.IP != nil {
+		if ip = addr.IP.To4(); ip == nil {
+			ip = addr.IP.To16()
+		}
+		port = addr.Port
+	}
+	b := []byte{socksVersion, code, 0x00, socksIPv4}
+	if len(ip) == net.IPv6len {
+		b[3] = socksIPv6
+	}
+	b = append(b, ip...)
+	b = append(b, byte(port>>8), byte(port))
+	_, err := w.Write(b)
+	return err
+}
+
+// bufferedConn reads from the reader which buffered the handshake.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// route dials destinations matching rules but not except through outbound.
+// Names are resolved before they are sent to the outbound if local is set,
+// otherwise the outbound resolves them. The rules on addresses of a route
+// with noResolve only match destinations given as addresses.
+type route struct {
+	outbound  DialerType
+	rules     *rules
+	except    *rules
+	local     bool
+	noResolve bool
+}
+
+func (r route) match(host string) bool {
+	return r.rules.match(host) && (r.except == nil || !r.except.match(host))
+}
+
+// lookup returns the outbound of the first route matching host, or direct
+// if none matches. If host is a name matching no route, its addresses are
+// resolved and matched against the routes with rules on addresses.
+func lookup(routes []route, host string) DialerType {
+	if r, ok := lookupRoute(routes, host); ok {
+		return r.outbound
+	}
+	return UseDirect
+}
+
+// lookupRoute returns the first route matching host as lookup does.
+func lookupRoute(routes []route, host string) (route, bool) {
+	for _, route := range routes {
+		if route.match(host) {
+			return route, true
+		}
+	}
+	if net.ParseIP(host) != nil {
+		return route{}, false
+	}
+	var ips []net.IP
+	var resolved bool
+	for _, route := range routes {
+		if route.noResolve || !route.rules.hasIP() {
+			continue
+		}
+		if !resolved {
+			ips, resolved = routeIPs(host), true
+		}
+		for _, ip := range ips {
+			if route.match(ip.String()) {
+				return route, true
+			}
+		}
+	}
+	return route{}, false
+}
+
+const (
+	routeCacheTTL  = 5 * time.Minute
+	routeCacheSize = 4096
+)
+
+// routeCache keeps the addresses which names matching no route resolved
+// to, or failed to, so that they are not resolved for every request.
+var routeCache = struct {
+	sync.Mutex
+	m map[string]routeCacheEntry
+}{m: make(map[string]routeCacheEntry)}
+
+type routeCacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// routeIPs returns the addresses of host for matching routes.
+func routeIPs(host string) []net.IP {
+	routeCache.Lock()
+	e, ok := routeCache.m[host]
+	routeCache.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.ips
+	}
+	ips, err := resolveIP(host)
+	if err != nil {
+		errorLogger.Printf("autoproxy: resolve %s: %s", host, err)
+	}
+	routeCache.Lock()
+	defer routeCache.Unlock()
+	if len(routeCache.m) >= routeCacheSize {
+		now := time.Now()
+		for k, v := range routeCache.m {
+			if now.After(v.expires) {
+				delete(routeCache.m, k)
+			}
+		}
+		if len(routeCache.m) >= routeCacheSize {
+			clear(routeCache.m)
+		}
+	}
+	routeCache.m[host] = routeCacheEntry{ips, time.Now().Add(routeCacheTTL)}
+	return ips
+}
+
+// Formats of autoproxy sources.
+const (
+	formatV2fly   = "v2fly"
+	formatGFWList = "gfwlist"
+	formatPlain   = "plain"
+	formatGeoIP   = "geoip"
+)
+
+// source is a list of autoproxy rules read from a URL or a file.
+type source struct {
+	location string
+	format   string
+	outbound DialerType
+	interval time.Duration
+	filter   attrFilter
+	// countries of a GeoIP source
+	countries []string
+	// resolve names locally before sending them to the outbound
+	local bool
+	// match rules on addresses only against destinations given as addresses
+	noResolve bool
+
+	mu      sync.Mutex
+	content string
+	match   *rules
+	except  *rules
+}
+
+// parseSources parses comma-separated sources. Each source is a URL or a
+// file, followed by options in query form after "#":
+//
+//	https://example.com/gfwlist.txt#format=gfwlist&action=proxy&interval=12h
+//
+// format is v2fly (default), gfwlist, plain or geoip, action is the
+// outbound: proxy (default), direct, reject or a named outbound, attrs
+// overrides filter for v2fly sources and country selects the countries of
+// geoip sources, and resolve is remote (default) to let a proxy outbound
+// resolve names or local to resolve them before. A no-resolve source
+// matches its rules on addresses only against destinations given as
+// addresses, never resolving names for them. An empty s is the v2fly
+// geolocation-!cn list.
+func parseSources(s string, filter attrFilter) ([]*source, error) {
+	if strings.TrimSpace(s) == "" {
+		s = autoproxyURL
+	}
+	var sources []*source
+	for i := range strings.SplitSeq(s, ",") {
+		location, options, _ := strings.Cut(strings.TrimSpace(i), "#")
+		if location == "" {
+			continue
+		}
+		query, err := url.ParseQuery(options)
+		if err != nil {
+			return nil, err
+		}
+		src := &source{location: location, format: formatV2fly, outbound: UseProxy, interval: autoproxyInterval, filter: filter}
+		if format := strings.ToLower(query.Get("format")); format != "" {
+			switch format {
+			case formatV2fly, formatGFWList, formatPlain, formatGeoIP:
+				src.format = format
+			case "abp":
+				src.format = formatGFWList
+			default:
+				return nil, errors.New("unknown autoproxy source format: " + format)
+			}
+		}
+		if s := query.Get("action"); s != "" {
+			src.outbound = DialerType(strings.ToLower(s))
+		}
+		if s := query.Get("interval"); s != "" {
+			if src.interval, err = time.ParseDuration(s); err != nil {
+				return nil, err
+			} else if src.interval <= 0 {
+				return nil, errors.New("bad autoproxy source interval: " + s)
+			}
+		}
+		switch resolve := strings.ToLower(query.Get("resolve")); resolve {
+		case "", "remote":
+		case "local":
+			src.local = true
+		default:
+			return nil, errors.New("unknown autoproxy source resolve: " + resolve)
+		}
+		src.noResolve = query.Has("no-resolve")
+		for _, i := range query["country"] {
+			src.countries = append(src.countries, strings.Fields(i)...)
+		}
+		if src.format == formatGeoIP && len(src.countries) == 0 {
+			return nil, errors.New("no country for geoip source: " + location)
+		}
+		if query.Has("attrs") {
+			if src.filter, err = parseAttrFilter(query.Get("attrs")); err != nil {
+				return nil, err
+			}
+		}
+		sources = append(sources, src)
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("no autoproxy source")
+	}
+	return sources, nil
+}
+
+func (s *source) isURL() bool {
+	u, err := url.Parse(s.location)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
+
+func (s *source) load(c *Client) (string, error) {
+	if s.isURL() {
+		return fetchCached(c, s.location)
+	}
+	b, err := os.ReadFile(s.location)
+	return string(b), err
+}
+
+// loadCache sets the source to its cached copy and returns when the copy
+// was fetched.
+func (s *source) loadCache() (time.Time, bool) {
+	content, entry, ok := loadCache(s.location)
+	if !ok {
+		return time.Time{}, false
+	}
+	s.set(content)
+	return entry.Fetched, true
+}
+
+// refresh loads the source and reports whether its content changed.
+func (s *source) refresh(c *Client) (bool, error) {
+	content, err := s.load(c)
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	changed := content != s.content
+	s.mu.Unlock()
+	if changed {
+		s.set(content)
+	}
+	return changed, nil
+}
+
+// set parses content as the rules of the source.
+func (s *source) set(content string) {
+	match, except := newRules(), newRules()
+	switch s.format {
+	case formatGFWList:
+		addABP(match, except, content)
+	case formatPlain:
+		addPlain(match, content)
+	case formatGeoIP:
+		if content != "" {
+			if err := addGeoIP(match, content, s.countries); err != nil {
+				errorLogger.Printf("autoproxy source %s: %s", s.location, err)
+			}
+		}
+	default:
+		(&domainList{match, includeList}).add(content, s.filter)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.content, s.match, s.except = content, match, except
+}
+
+// buildRoutes orders the rules of the custom file and sources: the custom
+// file comes first, then rejected, then direct, then the rules of other
+// outbounds in the order of sources. Exceptions of a source exempt hosts
+// from the rules of its outbound. Sources of an outbound resolving names
+// differently, or not matching names by address, are kept in separate
+// routes.
+func buildRoutes(custom *rules, sources []*source) []route {
+	var routes []route
+	if custom != nil && !custom.empty() {
+		routes = append(routes, route{UseProxy, custom, nil, false, false})
+	}
+	type key struct {
+		outbound  DialerType
+		local     bool
+		noResolve bool
+	}
+	keys := []key{{UseReject, false, false}, {UseDirect, false, false}}
+	merged := map[key]*route{}
+	for _, i := range keys {
+		merged[i] = &route{i.outbound, newRules(), newRules(), false, false}
+	}
+	for _, s := range sources {
+		s.mu.Lock()
+		if s.match != nil {
+			k := key{s.outbound, s.local && s.outbound != UseDirect && s.outbound != UseReject, s.noResolve}
+			r, ok := merged[k]
+			if !ok {
+				r = &route{k.outbound, newRules(), newRules(), k.local, k.noResolve}
+				merged[k] = r
+				keys = append(keys, k)
+			}
+			r.rules.merge(s.match)
+			r.except.merge(s.except)
+		}
+		s.mu.Unlock()
+	}
+	for _, k := range keys {
+		if r := merged[k]; !r.rules.empty() {
+			if r.except.empty() {
+				r.except = nil
+			}
+			routes = append(routes, *r)
+		}
+	}
+	return routes
+}
+
+// addABP adds rules in GFWList or Adblock Plus syntax, which may be base64
+// encoded. Only the host part of a pattern is used, so patterns on paths
+// and regular expressions on URLs are skipped. Exceptions starting with
+// "@@" are added to except.
+func addABP(match, except *rules, s string) {
+	if b, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), "")); err == nil {
+		s = string(b)
+	}
+	for line := range strings.Lines(s) {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		r := match
+		if rest, ok := strings.CutPrefix(line, "@@"); ok {
+			r, line = except, rest
+		}
+		if i := strings.IndexByte(line, '$'); i != -1 {
+			line = line[:i]
+		}
+		if len(line) > 1 && line[0] == '/' && line[len(line)-1] == '/' {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "||"):
+			addABPHost(r, abpHost(line[2:]), true, `(^|\.)`, `$`)
+		case strings.HasPrefix(line, "|"):
+			addABPHost(r, abpHost(trimScheme(line[1:])), false, `^`, `$`)
+		default:
+			addABPHost(r, strings.TrimLeft(abpHost(trimScheme(line)), "."), true, "", "")
+		}
+	}
+}
+
+// addABPHost adds host as a zone if zone is true, or as a host. A host
+// with wildcards is added as a regular expression between prefix and suffix.
+func addABPHost(r *rules, host string, zone bool, prefix, suffix string) {
+	switch {
+	case host == "":
+	case strings.Contains(host, "*"):
+		r.addRegexp(prefix + strings.ReplaceAll(regexp.QuoteMeta(host), `\*`, `.*`) + suffix)
+	case net.ParseIP(host) != nil:
+		r.addFromString(host)
+	case zone:
+		r.addZone(host)
+	default:
+		r.addHost(host)
+	}
+}
+
+// abpHost returns the host part of an ABP pattern.
+func abpHost(s string) string {
+	if i := strings.IndexAny(s, "/^|:?"); i != -1 {
+		s = s[:i]
+	}
+	return strings.ToLower(strings.TrimSuffix(s, "."))
+}
+
+func trimScheme(s string) string {
+	if i := strings.Index(s, "://"); i != -1 {
+		return s[i+3:]
+	}
+	return s
+}
+
+// addPlain adds a plain list with one domain, IP or CIDR per line.
+// Domains match their subdomains too.
+func addPlain(r *rules, s string) {
+	for line := range strings.Lines(s) {
+		line, _, _ = strings.Cut(line, "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(line); err == nil || net.ParseIP(line) != nil {
+			r.addFromString(line)
+		} else {
+			r.addZone(strings.TrimPrefix(line, "*."))
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"io/fs"
 	"os"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,27 +21,41 @@ import (
 
 var usagePool = pool.New[usage]()
 
+type traffic struct {
+	today, weekly, monthly, total unit.ByteSize
+}
+
+func (t *traffic) load(c *counters) {
+	t.today = unit.ByteSize(c.today.Get())
+	t.weekly = unit.ByteSize(c.weekly.Get())
+	t.monthly = unit.ByteSize(c.monthly.Get())
+	t.total = unit.ByteSize(c.total.Get())
+}
+
 type usage struct {
-	user                  user
-	today, monthly, total unit.ByteSize
+	user             user
+	download, upload traffic
+	active           int64
 }
 
-func (res usage) String(length [3]int) string {
-	return fmt.Sprint(
-		res.user.name, strings.Repeat(" ", length[0]-len(res.user.name)+3),
-		res.today, strings.Repeat(" ", length[1]-len(res.today.String())+3),
-		res.monthly, strings.Repeat(" ", length[2]-len(res.monthly.String())+3),
-		res.total,
-	)
+var usageHeader = []string{"user", "today", "weekly", "monthly", "total", "up-today", "up-weekly", "up-monthly", "up-total", "conns"}
+
+func (res usage) columns() []string {
+	return []string{
+		res.user.name,
+		res.download.today.String(), res.download.weekly.String(), res.download.monthly.String(), res.download.total.String(),
+		res.upload.today.String(), res.upload.weekly.String(), res.upload.monthly.String(), res.upload.total.String(),
+		strconv.FormatInt(res.active, 10),
+	}
 }
 
 func getUsage(user user) *usage {
 	if v, ok := recordMap.Load(user); ok {
 		res := usagePool.Get()
 		res.user = user
-		res.today = unit.ByteSize(v.today.Get())
-		res.monthly = unit.ByteSize(v.monthly.Get())
-		res.total = unit.ByteSize(v.total.Get())
+		res.download.load(&v.download)
+		res.upload.load(&v.upload)
+		res.active = v.active.Load()
 		return res
 	}
 	return nil
@@ -66,45 +81,37 @@ func writeUsages(base *Base, w io.Writer) {
 	})
 
 	slices.SortStableFunc(res, func(a, b *usage) int {
-		if a.today == b.today {
-			if a.monthly == b.monthly {
-				return -cmp.Compare(a.total, b.total)
-			}
-			return -cmp.Compare(a.monthly, b.monthly)
-		}
-		return -cmp.Compare(a.today, b.today)
+		return -cmp.Or(
+			cmp.Compare(a.download.today+a.upload.today, b.download.today+b.upload.today),
+			cmp.Compare(a.download.monthly+a.upload.monthly, b.download.monthly+b.upload.monthly),
+			cmp.Compare(a.download.total+a.upload.total, b.download.total+b.upload.total),
+		)
 	})
 
-	length := [3]int{4, 5, 7}
+	rows := [][]string{usageHeader}
 	for _, i := range res {
-		if l := len(i.user.name); l > length[0] {
-			length[0] = l
-		}
-		if l := len(i.today.String()); l > length[1] {
-			length[1] = l
-		}
-		if l := len(i.monthly.String()); l > length[2] {
-			length[2] = l
+		rows = append(rows, i.columns())
+		usagePool.Put(i)
+	}
+	length := make([]int, len(usageHeader))
+	for _, row := range rows {
+		for i, s := range row {
+			length[i] = max(length[i], len(s))
 		}
 	}
-
-	fmt.Fprint(
-		w,
-		"user", strings.Repeat(" ", length[0]-1),
-		"today", strings.Repeat(" ", length[1]-2),
-		"monthly", strings.Repeat(" ", length[2]-4),
-		"total\n",
-	)
-	for _, i := range res {
-		fmt.Fprintln(w, i.String(length))
-		usagePool.Put(i)
+	for _, row := range rows {
+		for i, s := range row[:len(row)-1] {
+			fmt.Fprint(w, s, strings.Repeat(" ", length[i]-len(s)+3))
+		}
+		fmt.Fprintln(w, row[len(row)-1])
 	}
 }
 
 var start time.Time
 
-func saveStatus(base *Base, servers []*httpsvr.Server) {
-	checkDayChange()
+func saveStatus(base *Base, servers []*httpsvr.Server, pool *Pool) {
+	rollRecords(base, time.Now())
+	checkQuotas(base)
 
 	f, err := os.Create(*status)
 	if err != nil {
@@ -124,10 +131,14 @@ func saveStatus(base *Base, servers []*httpsvr.Server) {
 	}
 	fmt.Fprintf(f, "Send: %s   Receive: %s\n", unit.ByteSize(send), unit.ByteSize(receive))
 	fmt.Fprintln(f)
+	if pool != nil {
+		pool.WriteStatus(f)
+		fmt.Fprintln(f)
+	}
 	writeUsages(base, f)
 }
 
-func initStatus(base *Base, servers []*httpsvr.Server) {
+func initStatus(base *Base, servers []*httpsvr.Server, pool *Pool) {
 	accessLogger.Debug("status: " + *status)
 	if _, err := os.Stat(*status); err == nil {
 		if err := keepStatus(0); err != nil {
@@ -140,8 +151,8 @@ func initStatus(base *Base, servers []*httpsvr.Server) {
 	}
 
 	start = time.Now()
-	saveStatus(base, servers)
-	scheduler.NewScheduler().At(scheduler.AtSecond(0)).Do(func(scheduler.Event) { saveStatus(base, servers) })
+	saveStatus(base, servers, pool)
+	scheduler.NewScheduler().At(scheduler.AtSecond(0)).Do(func(scheduler.Event) { saveStatus(base, servers, pool) })
 }
 
 func keepStatus(n int) (err error) {
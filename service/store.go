@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sunshineplan/httpproxy/auth"
+	"github.com/sunshineplan/utils/txt"
+)
+
+// The record file is a header line of storeMagic, the version, the time
+// saved and the count of records, a JSON line for each record, and a line
+// of the SHA-256 checksum of everything before it. Files of the first
+// version are gzipped lines read by parseRecord.
+const (
+	storeMagic   = "httpproxy-usage"
+	storeVersion = 2
+)
+
+var errStoreChecksum = errors.New("record file checksum mismatch")
+
+type storedCounters struct {
+	Today   int64   `json:"today"`
+	Weekly  int64   `json:"weekly"`
+	Monthly int64   `json:"monthly"`
+	Total   int64   `json:"total"`
+	History []int64 `json:"history,omitempty"`
+}
+
+type storedRecord struct {
+	User      string         `json:"user"`
+	Whitelist bool           `json:"whitelist,omitempty"`
+	Day       time.Time      `json:"day"`
+	Download  storedCounters `json:"download"`
+	Upload    storedCounters `json:"upload"`
+	Warned    [3]int         `json:"warned"`
+}
+
+func (c *counters) stored() storedCounters {
+	return storedCounters{c.today.Get(), c.weekly.Get(), c.monthly.Get(), c.total.Get(), c.history}
+}
+
+func (r *record) stored(u user) storedRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return storedRecord{u.name, u.whitelist, r.day, r.download.stored(), r.upload.stored(), r.warned}
+}
+
+// restore stores the record. A record which has not started a day starts
+// on the day it was saved.
+func (s storedRecord) restore(saved time.Time) {
+	v := store(
+		user{s.User, s.Whitelist},
+		[3]int64{s.Download.Today, s.Download.Monthly, s.Download.Total},
+		[3]int64{s.Upload.Today, s.Upload.Monthly, s.Upload.Total},
+	)
+	v.download.weekly.Add(s.Download.Weekly)
+	v.upload.weekly.Add(s.Upload.Weekly)
+	v.download.history = s.Download.History[:min(len(s.Download.History), historyDays)]
+	v.upload.history = s.Upload.History[:min(len(s.Upload.History), historyDays)]
+	v.warned = s.Warned
+	if v.day = s.Day; v.day.IsZero() {
+		v.day = window{}.day(saved)
+	}
+}
+
+func encodeStore(saved time.Time, records []storedRecord) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %d %s %d\n", storeMagic, storeVersion, saved.Format(timeFormat), len(records))
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	fmt.Fprintf(&b, "sha256 %x\n", sha256.Sum256(b.Bytes()))
+	return b.Bytes(), nil
+}
+
+func decodeStore(b []byte) (saved time.Time, records []storedRecord, err error) {
+	i := bytes.LastIndexByte(bytes.TrimSuffix(b, []byte("\n")), '\n')
+	if i == -1 {
+		return saved, nil, errors.New("truncated record file")
+	}
+	body, trailer := b[:i+1], string(bytes.TrimSpace(b[i+1:]))
+	if trailer != fmt.Sprintf("sha256 %x", sha256.Sum256(body)) {
+		return saved, nil, errStoreChecksum
+	}
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	header := strings.Fields(lines[0])
+	if len(header) != 4 || header[0] != storeMagic {
+		return saved, nil, errors.New("bad record file header: " + lines[0])
+	}
+	if version, err := strconv.Atoi(header[1]); err != nil || version != storeVersion {
+		return saved, nil, errors.New("unsupported record file version: " + header[1])
+	}
+	if saved, err = time.Parse(timeFormat, header[2]); err != nil {
+		return
+	}
+	if n, err := strconv.Atoi(header[3]); err != nil || n != len(lines)-1 {
+		return saved, nil, errors.New("bad record count: " + header[3])
+	}
+	for _, line := range lines[1:] {
+		var r storedRecord
+		if err = json.Unmarshal([]byte(line), &r); err != nil {
+			return
+		}
+		records = append(records, r)
+	}
+	return
+}
+
+// readRecords loads the records of file, which is either version of the
+// record file. Nothing is loaded from a damaged file.
+func readRecords(file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if len(b) >= 2 && b[0] == 0x1f && b[1] == 0x8b {
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		rows, err := txt.ReadAll(zr)
+		if err != nil {
+			return err
+		}
+		parseRecord(rows)
+		accessLogger.Print("migrating record file of version 1: " + file)
+		return nil
+	}
+	saved, records, err := decodeStore(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	for _, r := range records {
+		r.restore(saved)
+	}
+	return nil
+}
+
+// saveRecord saves the records of base to the record file, atomically and
+// keeping the previous file as a backup.
+func saveRecord(base *Base) error {
+	var records []storedRecord
+	base.accounts.Range(func(a auth.Basic, _ *limit) bool {
+		if v, ok := recordMap.Load(user{a.Username, false}); ok {
+			records = append(records, v.stored(user{a.Username, false}))
+		}
+		return true
+	})
+	base.whitelist.Range(func(a allow, _ *limit) bool {
+		if v, ok := recordMap.Load(user{string(a), true}); ok {
+			records = append(records, v.stored(user{string(a), true}))
+		}
+		return true
+	})
+	b, err := encodeStore(time.Now(), records)
+	if err != nil {
+		return err
+	}
+	if err := backupFile(recordFile); err != nil {
+		return err
+	}
+	return writeFile(recordFile, b)
+}
+
+// backupFile keeps the content of file as file.bak before file is
+// replaced, so that file is never missing. The backup is a hard link to
+// file where it can be, or a copy.
+func backupFile(file string) error {
+	tmp := file + ".bak.tmp"
+	os.Remove(tmp)
+	if err := os.Link(file, tmp); err == nil {
+		return os.Rename(tmp, file+".bak")
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return writeFile(file+".bak", b)
+}
+
+// dayUsage is the traffic of a user on a day.
+type dayUsage struct {
+	Date     string `json:"date"`
+	Download int64  `json:"download"`
+	Upload   int64  `json:"upload"`
+}
+
+// days returns the traffic of each day kept by the record, today first.
+func (r *record) days() []dayUsage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	day := r.day
+	if day.IsZero() {
+		day = window{}.day(time.Now())
+	}
+	res := []dayUsage{{day.Format(time.DateOnly), r.download.today.Get(), r.upload.today.Get()}}
+	for i := range max(len(r.download.history), len(r.upload.history)) {
+		d := dayUsage{Date: day.AddDate(0, 0, -i-1).Format(time.DateOnly)}
+		if i < len(r.download.history) {
+			d.Download = r.download.history[i]
+		}
+		if i < len(r.upload.history) {
+			d.Upload = r.upload.history[i]
+		}
+		res = append(res, d)
+	}
+	return res
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sunshineplan/limiter"
+)
+
+var errNotTCP = errors.New("not a TCP connection")
+
+// Transparent accepts connections redirected to it by iptables or nftables
+// REDIRECT or TPROXY rules and sends them on through the client, as the
+// autoproxy rules decide if autoproxy is enabled. Redirected clients can
+// not authenticate, so with a whitelist or accounts only whitelisted
+// addresses are allowed.
+type Transparent struct {
+	client *Client
+	Port   string
+	tproxy bool
+
+	mu       sync.Mutex
+	listener net.Listener
+	closed   bool
+}
+
+// Transparent returns a transparent frontend of the client. tproxy selects
+// TPROXY rules instead of REDIRECT.
+func (c *Client) Transparent(port string, tproxy bool) *Transparent {
+	return &Transparent{client: c, Port: port, tproxy: tproxy}
+}
+
+func (t *Transparent) Run() error {
+	listener, err := listenTransparent(net.JoinHostPort(t.client.Host, t.Port), t.tproxy)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return listener.Close()
+	}
+	t.listener = listener
+	t.mu.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go t.serve(conn)
+	}
+}
+
+// Close stops the listener, or keeps Run from starting it if it has not
+// yet.
+func (t *Transparent) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	if t.listener == nil {
+		return nil
+	}
+	return t.listener.Close()
+}
+
+func (t *Transparent) serve(conn net.Conn) {
+	remoteAddr := conn.RemoteAddr().String()
+	dst, err := originalDestination(conn, t.tproxy)
+	if err != nil {
+		errorLogger.Printf("%s transparent: %s", remoteAddr, err)
+		conn.Close()
+		return
+	}
+	// a connection made to the listener itself would loop forever
+	if local := conn.LocalAddr().(*net.TCPAddr); !t.tproxy && dst.IP.Equal(local.IP) && dst.Port == local.Port {
+		errorLogger.Printf("%s transparent: connection to the listener itself", remoteAddr)
+		conn.Close()
+		return
+	}
+	u, speed, ok := t.auth(remoteAddr)
+	if !ok {
+		conn.Close()
+		return
+	}
+	defer leave(u)
+	lim := shape("transparent", u, remoteAddr, speed)
+	defer lim.leave()
+
+	address := dst.String()
+	if sniffPort(strconv.Itoa(dst.Port)) {
+		var host string
+		if host, conn = sniffHost(conn); host != "" {
+			address = net.JoinHostPort(host, strconv.Itoa(dst.Port))
+		}
+	}
+
+	var name string
+	if u.name != "" {
+		name = "[" + u.name + "]"
+	}
+	metrics.requests.with("transparent").Add(1)
+	start := time.Now()
+	dest, err := t.client.dial(address, t.client.autoproxy != nil)
+	typ, ok := IsTyped(dest, err)
+	observeDial(typ, start)
+	var direct bool
+	if ok {
+		accessLogger.Printf("[%s]%s%s TRANSPARENT %s", typ, remoteAddr, name, address)
+		direct = typ == UseDirect
+	} else {
+		accessLogger.Printf("[C]%s%s TRANSPARENT %s", remoteAddr, name, address)
+	}
+	if err != nil {
+		if typ != UseReject {
+			errorLogger.Println(err)
+		}
+		conn.Close()
+		return
+	}
+
+	if jsonLogger != nil {
+		e := newEntry(remoteAddr, "TRANSPARENT", address)
+		e.user = u
+		if ok {
+			e.dialer = typ
+		} else {
+			e.dialer = UseProxy
+		}
+		conn = &logConn{Conn: conn, e: e}
+	}
+	if direct {
+		pipe(conn, dest, user{}, nil)
+	} else {
+		pipe(conn, dest, u, lim)
+	}
+}
+
+// auth allows whitelisted addresses, or everyone if there are neither
+// whitelist nor accounts.
+func (t *Transparent) auth(remoteAddr string) (user, *limiter.Limiter, bool) {
+	base := t.client.Base
+	hasWhitelist, hasAccount := base.hasWhitelist(), base.hasAccount()
+	if !hasWhitelist && !hasAccount {
+		return user{}, limiter.New(limiter.Inf), true
+	}
+	if hasWhitelist {
+		if found, allow, exceeded, limit := base.isAllow(remoteAddr); found {
+			if exceeded {
+				metrics.limitExceeded.Add(1)
+				limit.st.Do(func() { accessLogger.Printf("%s[%s] Exceeded traffic limit", remoteAddr, allow) })
+				return user{}, nil, false
+			}
+			u := user{string(allow), true}
+			if reason, ok := enter(u, limit); !ok {
+				logOverCap(remoteAddr, u, limit, reason)
+				return user{}, nil, false
+			}
+			return u, limit.speed, true
+		}
+	}
+	metrics.notAllowed.Add(1)
+	notAllow.Do(func() { accessLogger.Printf("%s not allow", remoteAddr) })
+	return user{}, nil, false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenTransparent listens on address for redirected connections. With
+// tproxy the socket may accept connections to any address, as TPROXY
+// rules require.
+func listenTransparent(address string, tproxy bool) (net.Listener, error) {
+	var lc net.ListenConfig
+	if tproxy {
+		lc.Control = func(network, _ string, c syscall.RawConn) error {
+			var err error
+			if ctrlErr := c.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					err = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+				} else {
+					err = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+				}
+			}); ctrlErr != nil {
+				return ctrlErr
+			}
+			return err
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+// originalDestination returns the destination conn was sent to before it
+// was redirected. TPROXY keeps it as the local address, REDIRECT records it
+// in SO_ORIGINAL_DST.
+func originalDestination(conn net.Conn, tproxy bool) (*net.TCPAddr, error) {
+	if tproxy {
+		return conn.LocalAddr().(*net.TCPAddr), nil
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errNotTCP
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var addr *net.TCPAddr
+	if ctrlErr := rc.Control(func(fd uintptr) {
+		if local := conn.LocalAddr().(*net.TCPAddr); local.IP.To4() != nil {
+			var mreq *unix.IPv6Mreq // large enough for a sockaddr_in
+			if mreq, err = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST); err == nil {
+				b := mreq.Multiaddr
+				addr = &net.TCPAddr{IP: net.IPv4(b[4], b[5], b[6], b[7]), Port: int(binary.BigEndian.Uint16(b[2:4]))}
+			}
+		} else {
+			var info *unix.IPv6MTUInfo // starts with a sockaddr_in6
+			if info, err = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, unix.SO_ORIGINAL_DST); err == nil {
+				port := binary.NativeEndian.AppendUint16(nil, info.Addr.Port)
+				addr = &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(binary.BigEndian.Uint16(port))}
+			}
+		}
+	}); ctrlErr != nil {
+		return nil, ctrlErr
+	}
+	return addr, err
+}
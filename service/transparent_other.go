@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentUnsupported = errors.New("transparent proxy is only supported on Linux")
+
+func listenTransparent(string, bool) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+func originalDestination(net.Conn, bool) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
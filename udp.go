@@ -0,0 +1,117 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/sunshineplan/httpproxy/masque"
+)
+
+// dialUDP sets up a CONNECT-UDP tunnel to address. It prefers an extended
+// CONNECT stream on the HTTP/2 session and falls back to an HTTP/1.1 upgrade
+// when extended CONNECT can not be used on it.
+func (d *Dialer) dialUDP(ctx context.Context, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	path := masque.Path(host, port)
+	conn, s, err := d.dialProxy(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	if s != nil {
+		c, err := d.connectUDPH2(ctx, s, path, address)
+		if _, ok := err.(StatusError); err == nil || ok {
+			return c, err
+		}
+		if conn, _, err = d.dialProxy(ctx, false); err != nil {
+			return nil, err
+		}
+	}
+	conn, br, err := d.roundTrip(ctx, conn, &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Opaque: path},
+		Host:   d.proxyAddress,
+		Header: http.Header{
+			"Connection":       {"Upgrade"},
+			"Upgrade":          {masque.Protocol},
+			"Capsule-Protocol": {"?1"},
+		},
+	}, http.StatusSwitchingProtocols)
+	if err != nil {
+		return nil, err
+	}
+	return &udpConn{conn, br, udpAddr(address)}, nil
+}
+
+// connectUDPH2 opens a CONNECT-UDP stream on the HTTP/2 session.
+func (d *Dialer) connectUDPH2(ctx context.Context, s *session, path, address string) (net.Conn, error) {
+	c, err := d.stream(ctx, s, &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "https", Host: d.proxyAddress, Opaque: path},
+		Host:   d.proxyAddress,
+		Header: http.Header{
+			":protocol":        {masque.Protocol},
+			"Capsule-Protocol": {"?1"},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &udpConn{c, bufio.NewReader(c), udpAddr(address)}, nil
+}
+
+type udpAddr string
+
+func (udpAddr) Network() string  { return "udp" }
+func (a udpAddr) String() string { return string(a) }
+
+// udpConn carries UDP payloads as HTTP Datagrams over a CONNECT-UDP tunnel.
+type udpConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote udpAddr
+}
+
+var (
+	_ net.Conn       = &udpConn{}
+	_ net.PacketConn = &udpConn{}
+)
+
+func (c *udpConn) Read(b []byte) (int, error) {
+	p, err := masque.ReadDatagram(c.r)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	return copy(b, p), nil
+}
+
+func (c *udpConn) Write(b []byte) (int, error) {
+	if err := masque.WriteDatagram(c.Conn, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *udpConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.remote, err
+}
+
+func (c *udpConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if addr != nil && addr.String() != c.remote.String() {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: errors.New("use of WriteTo with pre-connected connection")}
+	}
+	return c.Write(b)
+}
+
+func (c *udpConn) RemoteAddr() net.Addr { return c.remote }